@@ -0,0 +1,134 @@
+package formula_engine
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"strings"
+	"unicode/utf8"
+)
+
+// 构造ast树的函数，用于不经过解析直接生成公式。构造的节点没有源码位置，位置均为-1。
+// 操作数为nil、变量名不合法时 panic，与 regexp.MustCompile 相同，参数应由程序保证正确；
+// Call 的参数来自外部输入（函数名），返回错误
+
+// synthetic 构造节点使用的token
+func synthetic(type_ TT, value string) *token {
+	return newToken(type_, value, -1, -1)
+}
+
+// Num 数字。负数构造为一元减号节点，与解析 "-1" 的结果相同
+func Num(d decimal.Decimal) AstNode {
+	node := newAstSinNode(synthetic(TTNum, d.Abs().String()))
+	if d.Sign() < 0 {
+		return Neg(node)
+	}
+	return node
+}
+
+// Str 字符串
+func Str(s string) AstNode {
+	return newAstSinNode(synthetic(TTString, s))
+}
+
+// Var 变量，name 不含'{}'。name 为空、不是合法的UTF-8或包含'\x00'时 panic
+func Var(name string) AstNode {
+	if checkVarName(name) != nil {
+		panic(fmt.Sprintf("formula_engine: invalid variable name %q", name))
+	}
+	return newAstSinNode(synthetic(TTIdentifier, name))
+}
+
+// checkVarName 校验变量名：不能为空，必须是合法的UTF-8且不含'\x00'
+func checkVarName(name string) error {
+	if name == "" || !utf8.ValidString(name) || strings.ContainsRune(name, 0) {
+		return makeErr(illegalSyntaxErrMsg, fmt.Sprintf("Invalid variable name %q", name))
+	}
+	return nil
+}
+
+// unary 构造一元节点，操作数为nil时 panic
+func unary(type_ TT, node AstNode) AstNode {
+	if node == nil {
+		panic(fmt.Sprintf("formula_engine: operand of '%s' must not be nil", opSymbols[type_]))
+	}
+	return newAstUnNode(synthetic(type_, opSymbols[type_]), node)
+}
+
+// binary 构造二叉节点，操作数为nil时 panic
+func binary(type_ TT, left, right AstNode) AstNode {
+	if left == nil || right == nil {
+		panic(fmt.Sprintf("formula_engine: operands of '%s' must not be nil", opSymbols[type_]))
+	}
+	return newAstBinNode(synthetic(type_, opSymbols[type_]), left, right)
+}
+
+// Neg 取负 -x
+func Neg(x AstNode) AstNode { return unary(TTMinus, x) }
+
+// Percent 百分号 x%
+func Percent(x AstNode) AstNode { return unary(TTPercent, x) }
+
+// Not 非 !x
+func Not(x AstNode) AstNode { return unary(TTNot, x) }
+
+// Add 加 a + b
+func Add(a, b AstNode) AstNode { return binary(TTPlus, a, b) }
+
+// Sub 减 a - b
+func Sub(a, b AstNode) AstNode { return binary(TTMinus, a, b) }
+
+// Mul 乘 a * b
+func Mul(a, b AstNode) AstNode { return binary(TTMul, a, b) }
+
+// Div 除 a / b
+func Div(a, b AstNode) AstNode { return binary(TTDiv, a, b) }
+
+// Pow 乘方 a ^ b
+func Pow(a, b AstNode) AstNode { return binary(TTPow, a, b) }
+
+// And 与 a & b
+func And(a, b AstNode) AstNode { return binary(TTAnd, a, b) }
+
+// Or 或 a | b
+func Or(a, b AstNode) AstNode { return binary(TTOr, a, b) }
+
+// Eq 等于 a = b
+func Eq(a, b AstNode) AstNode { return binary(TTEq, a, b) }
+
+// Neq 不等于 a != b
+func Neq(a, b AstNode) AstNode { return binary(TTNeq, a, b) }
+
+// Gt 大于 a > b
+func Gt(a, b AstNode) AstNode { return binary(TTGt, a, b) }
+
+// Gte 大于等于 a >= b
+func Gte(a, b AstNode) AstNode { return binary(TTGte, a, b) }
+
+// Lt 小于 a < b
+func Lt(a, b AstNode) AstNode { return binary(TTLt, a, b) }
+
+// Lte 小于等于 a <= b
+func Lte(a, b AstNode) AstNode { return binary(TTLte, a, b) }
+
+// Call 使用默认Engine构造函数调用
+func Call(name string, args ...AstNode) (AstNode, error) {
+	return defaultEngine.Call(name, args...)
+}
+
+// Call 构造函数调用，与解析时相同：函数名不区分大小写，函数必须已注册，参数个数必须正确
+func (e *Engine) Call(name string, args ...AstNode) (AstNode, error) {
+	tok := synthetic(TTFunction, strings.ToUpper(name))
+	spec, ok := e.lookupFunc(tok.Value)
+	if !ok {
+		return nil, syntaxErrWithToken(tok, fmt.Sprintf("UnKnow function name %s", tok.Value))
+	}
+	if err := spec.checkArgs(tok.Value, len(args)); err != nil {
+		return nil, withTok(err, tok)
+	}
+	for idx, arg := range args {
+		if arg == nil {
+			return nil, syntaxErrWithToken(tok, fmt.Sprintf("Argument %d must not be nil", idx+1))
+		}
+	}
+	return newAstGeneralNode(tok, args...), nil
+}
@@ -0,0 +1,124 @@
+package formula_engine
+
+import (
+	"github.com/shopspring/decimal"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// commutativeOps 满足交换律的运算符，+ * & | 同时满足结合律
+var commutativeOps = map[TT]bool{
+	TTPlus: true,
+	TTMul:  true,
+	TTAnd:  true,
+	TTOr:   true,
+	TTEq:   true,
+}
+
+// Equal 比较两个ast树的结构是否相同，忽略源码位置，数字按值比较（如 1.50 与 1.5 相同）
+func Equal(a, b AstNode) bool {
+	return canonical(a, false) == canonical(b, false)
+}
+
+// EqualCommutative 同 Equal，并忽略满足交换律的运算的操作数顺序：
+// + * & | 的连续运算视为无序的操作数集合（如 {a}+{b}+{c} 与 {c}+({b}+{a}) 相同），= 忽略两侧顺序。
+// 只比较结构：+ 用于拼接字符串时不满足交换律，交换 & | 的操作数会改变短路求值时报错的行为
+func EqualCommutative(a, b AstNode) bool {
+	return canonical(a, true) == canonical(b, true)
+}
+
+// Hash 稳定的64位哈希，不同进程、不同版本间相同的ast树结果相同。Equal 的两个ast树哈希相同
+func Hash(node AstNode) uint64 {
+	return hashString(canonical(node, false))
+}
+
+// HashCommutative EqualCommutative 的两个ast树哈希相同
+func HashCommutative(node AstNode) uint64 {
+	return hashString(canonical(node, true))
+}
+
+// hashString FNV-1a 哈希
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// canonical ast树的规范形式，不含位置，结构相同的树规范形式相同
+func canonical(node AstNode, commutative bool) string {
+	var str strings.Builder
+	writeCanonical(&str, node, commutative)
+	return str.String()
+}
+
+// writeCanonical 写入节点的规范形式
+func writeCanonical(str *strings.Builder, node AstNode, commutative bool) {
+	if node == nil {
+		str.WriteString("nil")
+		return
+	}
+	tok := node.GetTok()
+	switch n := node.(type) {
+	case *astSinNode:
+		switch tok.Type {
+		case TTNum:
+			str.WriteString("n:")
+			if d, err := decimal.NewFromString(tok.Value); err == nil {
+				str.WriteString(d.String())
+			} else {
+				str.WriteString(tok.Value)
+			}
+		case TTString:
+			str.WriteString("s:" + strconv.Quote(tok.Value))
+		case TTIdentifier:
+			str.WriteString("v:" + strconv.Quote(tok.Value))
+		default:
+			str.WriteString(string(tok.Type) + ":" + strconv.Quote(tok.Value))
+		}
+	case *astUnNode:
+		str.WriteString("(" + string(tok.Type) + " ")
+		writeCanonical(str, n.Node, commutative)
+		str.WriteByte(')')
+	case *astBinNode:
+		str.WriteString("(" + string(tok.Type))
+		if commutative && commutativeOps[tok.Type] {
+			operands := []AstNode{n.LNode, n.RNode}
+			if tok.Type != TTEq {
+				operands = flatten(n, tok.Type, nil)
+			}
+			keys := make([]string, 0, len(operands))
+			for _, o := range operands {
+				keys = append(keys, canonical(o, commutative))
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				str.WriteString(" " + k)
+			}
+		} else {
+			str.WriteByte(' ')
+			writeCanonical(str, n.LNode, commutative)
+			str.WriteByte(' ')
+			writeCanonical(str, n.RNode, commutative)
+		}
+		str.WriteByte(')')
+	case *astGeneralNode:
+		str.WriteString("(f:" + strings.ToUpper(tok.Value))
+		for _, c := range n.Nodes {
+			str.WriteByte(' ')
+			writeCanonical(str, c, commutative)
+		}
+		str.WriteByte(')')
+	}
+}
+
+// flatten 收集连续的同一运算符的操作数，如 ({a}+{b})+{c} 收集为 {a} {b} {c}
+func flatten(node AstNode, type_ TT, operands []AstNode) []AstNode {
+	n, ok := node.(*astBinNode)
+	if !ok || n.Tok.Type != type_ {
+		return append(operands, node)
+	}
+	operands = flatten(n.LNode, type_, operands)
+	return flatten(n.RNode, type_, operands)
+}
@@ -0,0 +1,177 @@
+package formula_engine
+
+import "github.com/shopspring/decimal"
+
+// Expr ast节点的只读视图，供包外分析ast树，通过 ToExpr 获取。具体类型为
+// *NumberLit、*StringLit、*VarRef、*UnaryExpr、*BinaryExpr、*CallExpr、*IllegalExpr
+type Expr interface {
+	// Node 返回对应的ast节点，可用于计算、格式化等
+	Node() AstNode
+	// Span 节点token的源码位置：一元、二元节点为运算符的位置，函数为函数名的位置
+	Span() Span
+}
+
+// ToExpr 获取ast节点的视图，node 为nil时返回nil
+func ToExpr(node AstNode) Expr {
+	switch n := node.(type) {
+	case *astSinNode:
+		switch n.Tok.Type {
+		case TTNum:
+			return &NumberLit{n}
+		case TTString:
+			return &StringLit{n}
+		case TTIdentifier:
+			return &VarRef{n}
+		}
+		return &IllegalExpr{n}
+	case *astUnNode:
+		if n.Tok.Type == TTIllegal {
+			return &IllegalExpr{n}
+		}
+		return &UnaryExpr{n}
+	case *astBinNode:
+		return &BinaryExpr{n}
+	case *astGeneralNode:
+		return &CallExpr{n}
+	}
+	return nil
+}
+
+// NumberLit 数字
+type NumberLit struct {
+	n *astSinNode
+}
+
+func (e *NumberLit) Node() AstNode { return e.n }
+func (e *NumberLit) Span() Span    { return e.n.Tok.span() }
+
+// Text 数字的原文
+func (e *NumberLit) Text() string {
+	return e.n.Tok.Value
+}
+
+// Value 数字的值，原文不是合法数字时（如手动构造的节点）ok为false
+func (e *NumberLit) Value() (d decimal.Decimal, ok bool) {
+	d, err := decimal.NewFromString(e.n.Tok.Value)
+	return d, err == nil
+}
+
+// StringLit 字符串
+type StringLit struct {
+	n *astSinNode
+}
+
+func (e *StringLit) Node() AstNode { return e.n }
+func (e *StringLit) Span() Span    { return e.n.Tok.span() }
+
+// Value 字符串转义后的值
+func (e *StringLit) Value() string {
+	return e.n.Tok.Value
+}
+
+// VarRef 变量引用
+type VarRef struct {
+	n *astSinNode
+}
+
+func (e *VarRef) Node() AstNode { return e.n }
+func (e *VarRef) Span() Span    { return e.n.Tok.span() }
+
+// Name 变量名，不含'{}'
+func (e *VarRef) Name() string {
+	return e.n.Tok.Value
+}
+
+// UnaryExpr 一元运算，如 -{x}、!{a}、5%
+type UnaryExpr struct {
+	n *astUnNode
+}
+
+func (e *UnaryExpr) Node() AstNode { return e.n }
+func (e *UnaryExpr) Span() Span    { return e.n.Tok.span() }
+
+// Op 运算符：TTPlus、TTMinus、TTNot，及后缀运算符 TTPercent
+func (e *UnaryExpr) Op() TT {
+	return e.n.Tok.Type
+}
+
+// Operand 操作数
+func (e *UnaryExpr) Operand() Expr {
+	return ToExpr(e.n.Node)
+}
+
+// BinaryExpr 二元运算，如 {a} + 1、{a} > {b}
+type BinaryExpr struct {
+	n *astBinNode
+}
+
+func (e *BinaryExpr) Node() AstNode { return e.n }
+func (e *BinaryExpr) Span() Span    { return e.n.Tok.span() }
+
+// Op 运算符，如 TTPlus、TTGte、TTAnd
+func (e *BinaryExpr) Op() TT {
+	return e.n.Tok.Type
+}
+
+// Left 左操作数
+func (e *BinaryExpr) Left() Expr {
+	return ToExpr(e.n.LNode)
+}
+
+// Right 右操作数
+func (e *BinaryExpr) Right() Expr {
+	return ToExpr(e.n.RNode)
+}
+
+// CallExpr 函数调用
+type CallExpr struct {
+	n *astGeneralNode
+}
+
+func (e *CallExpr) Node() AstNode { return e.n }
+func (e *CallExpr) Span() Span    { return e.n.Tok.span() }
+
+// Name 函数名，大写
+func (e *CallExpr) Name() string {
+	return e.n.Tok.Value
+}
+
+// NumArgs 参数个数
+func (e *CallExpr) NumArgs() int {
+	return len(e.n.Nodes)
+}
+
+// Arg 第i个参数，从0开始
+func (e *CallExpr) Arg(i int) Expr {
+	return ToExpr(e.n.Nodes[i])
+}
+
+// Args 所有参数
+func (e *CallExpr) Args() []Expr {
+	args := make([]Expr, 0, len(e.n.Nodes))
+	for _, n := range e.n.Nodes {
+		args = append(args, ToExpr(n))
+	}
+	return args
+}
+
+// IllegalExpr 非法节点，只在容错解析的结果中出现：出错的部分，或有错误时包裹部分ast树的根节点
+type IllegalExpr struct {
+	n AstNode
+}
+
+func (e *IllegalExpr) Node() AstNode { return e.n }
+func (e *IllegalExpr) Span() Span    { return e.n.GetTok().span() }
+
+// Text 出错部分的原文，根节点为整个公式
+func (e *IllegalExpr) Text() string {
+	return e.n.GetTok().Value
+}
+
+// Partial 根节点包裹的部分ast树，出错的部分返回nil
+func (e *IllegalExpr) Partial() Expr {
+	if n, ok := e.n.(*astUnNode); ok {
+		return ToExpr(n.Node)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package formula_engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// astSchemaVersion ast树JSON格式的版本，格式不兼容地变化时递增
+const astSchemaVersion = 1
+
+// JSON中的节点类别
+const (
+	jsonKindSingle = "single"
+	jsonKindUnary  = "unary"
+	jsonKindBinary = "binary"
+	jsonKindCall   = "call"
+)
+
+// jsonAst ast树的JSON格式
+type jsonAst struct {
+	Version int       `json:"version"`
+	Root    *jsonNode `json:"root"`
+}
+
+// jsonNode 节点的JSON格式，Children 依次为一元节点的操作数、二叉节点的左右操作数、函数的参数
+type jsonNode struct {
+	Kind      string      `json:"kind"`
+	Type      TT          `json:"type"`
+	Value     string      `json:"value"`
+	Start     int         `json:"start"`
+	End       int         `json:"end"`
+	StartRune int         `json:"startRune"`
+	EndRune   int         `json:"endRune"`
+	Children  []*jsonNode `json:"children,omitempty"`
+}
+
+// EncodeAST 将ast树编码为JSON，包含token类型、值及源码位置
+func EncodeAST(node AstNode) ([]byte, error) {
+	if node == nil {
+		return nil, makeErr(systemErrMsg, "Cannot encode a nil node")
+	}
+	return json.Marshal(jsonAst{Version: astSchemaVersion, Root: encodeNode(node)})
+}
+
+// encodeNode 转为JSON格式的节点
+func encodeNode(node AstNode) *jsonNode {
+	tok := node.GetTok()
+	res := &jsonNode{Type: tok.Type, Value: tok.Value, Start: tok.Start, End: tok.End, StartRune: tok.StartRune, EndRune: tok.EndRune}
+	switch node.GetName() {
+	case astSinNodeName:
+		res.Kind = jsonKindSingle
+	case astUnNodeName:
+		res.Kind = jsonKindUnary
+		res.Children = []*jsonNode{encodeNode(node.(*astUnNode).Node)}
+	case astBinNodeName:
+		n := node.(*astBinNode)
+		res.Kind = jsonKindBinary
+		res.Children = []*jsonNode{encodeNode(n.LNode), encodeNode(n.RNode)}
+	case astGeneralNodeName:
+		res.Kind = jsonKindCall
+		for _, c := range node.(*astGeneralNode).Nodes {
+			res.Children = append(res.Children, encodeNode(c))
+		}
+	}
+	return res
+}
+
+// DecodeAST 使用默认Engine解码 EncodeAST 生成的JSON
+func DecodeAST(data []byte) (AstNode, error) {
+	return defaultEngine.DecodeAST(data)
+}
+
+// DecodeAST 解码 EncodeAST 生成的JSON，并按Engine校验：运算符必须存在于运算符表，函数必须已注册且参数个数正确，
+// 数字必须合法，不接受非法节点。校验失败时返回定位到该节点的 *SyntaxError
+func (e *Engine) DecodeAST(data []byte) (AstNode, error) {
+	var ast jsonAst
+	if err := json.Unmarshal(data, &ast); err != nil {
+		return nil, makeErr(systemErrMsg, fmt.Sprintf("Invalid ast json: %s", err.Error()))
+	}
+	if ast.Version != astSchemaVersion {
+		return nil, makeErr(systemErrMsg, fmt.Sprintf("Unsupported ast json version %d, expected %d", ast.Version, astSchemaVersion))
+	}
+	if ast.Root == nil {
+		return nil, makeErr(systemErrMsg, "Missing root node in ast json")
+	}
+	return e.decodeNode(ast.Root)
+}
+
+// decodeNode 校验并转为ast节点，先校验节点本身，再校验子节点
+func (e *Engine) decodeNode(n *jsonNode) (AstNode, error) {
+	tok := newTokenAt(n.Type, n.Value, Span{Start: n.Start, End: n.End, StartRune: n.StartRune, EndRune: n.EndRune})
+	if err := e.checkJsonNode(n, tok); err != nil {
+		return nil, err
+	}
+	children := make([]AstNode, 0, len(n.Children))
+	for _, c := range n.Children {
+		if c == nil {
+			return nil, syntaxErrWithToken(tok, "Child node must not be null")
+		}
+		child, err := e.decodeNode(c)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	switch n.Kind {
+	case jsonKindUnary:
+		return newAstUnNode(tok, children[0]), nil
+	case jsonKindBinary:
+		return newAstBinNode(tok, children[0], children[1]), nil
+	case jsonKindCall:
+		return newAstGeneralNode(tok, children...), nil
+	}
+	if n.Type == TTNum {
+		// 数字转为词法分析器生成的形式，负数转为一元负号节点，保证 Format 的结果能被解析为相同的ast树
+		lit, neg, _ := e.numberLiteral(n.Value)
+		tok.Value = lit
+		if neg {
+			return newAstUnNode(newTokenAt(TTMinus, "-", tok.span()), newAstSinNode(tok)), nil
+		}
+	}
+	return newAstSinNode(tok), nil
+}
+
+// numberLiteral 去掉数字的正负号，按词法分析器转为数字token的值，value 不是一个合法的数字时 ok 为false
+func (e *Engine) numberLiteral(value string) (lit string, neg bool, ok bool) {
+	if strings.HasPrefix(value, "-") || strings.HasPrefix(value, "+") {
+		neg, value = value[0] == '-', value[1:]
+	}
+	tokens, err := newLexer(value, e).MakeTokens()
+	if err != nil || len(tokens) != 2 || tokens[0].Type != TTNum || tokens[1].Type != TTEof {
+		return "", false, false
+	}
+	return tokens[0].Value, neg, true
+}
+
+// checkJsonNode 校验节点类别、token类型、值及子节点个数，函数名转为大写
+func (e *Engine) checkJsonNode(n *jsonNode, tok *token) error {
+	var required int
+	switch n.Kind {
+	case jsonKindSingle:
+		switch n.Type {
+		case TTNum:
+			if _, _, ok := e.numberLiteral(n.Value); !ok {
+				return syntaxErrWithToken(tok, fmt.Sprintf("Invalid number '%s'", n.Value))
+			}
+		case TTIdentifier:
+			if n.Value == "" {
+				return syntaxErrWithToken(tok, "Identifier must not be empty")
+			}
+		case TTString:
+		default:
+			return syntaxErrWithToken(tok, fmt.Sprintf("UnExpected tokType:'%s' for a single node", n.Type))
+		}
+	case jsonKindUnary:
+		if _, ok := e.unVisMap[n.Type]; !ok {
+			return syntaxErrWithToken(tok, fmt.Sprintf("UnKnow Unary type %s", n.Type))
+		}
+		required = 1
+	case jsonKindBinary:
+		if _, ok := e.binVisMap[n.Type]; !ok {
+			return syntaxErrWithToken(tok, fmt.Sprintf("UnKnow Binary type %s", n.Type))
+		}
+		required = 2
+	case jsonKindCall:
+		if n.Type != TTFunction {
+			return syntaxErrWithToken(tok, fmt.Sprintf("UnExpected tokType:'%s' for a call node", n.Type))
+		}
+		tok.Value = strings.ToUpper(tok.Value)
+		spec, ok := e.lookupFunc(tok.Value)
+		if !ok {
+			return syntaxErrWithToken(tok, fmt.Sprintf("UnKnow function name %s", tok.Value))
+		}
+		return locate(spec.checkArgs(tok.Value, len(n.Children)), tok)
+	default:
+		return syntaxErrWithToken(tok, fmt.Sprintf("UnKnow node kind '%s'", n.Kind))
+	}
+	if len(n.Children) != required {
+		return syntaxErrWithToken(tok, fmt.Sprintf("Node of kind '%s' requires %d children, got %d", n.Kind, required, len(n.Children)))
+	}
+	return nil
+}
@@ -24,6 +24,9 @@ func DeepCopyAstNode(node AstNode) AstNode {
 			Value: sNode.Tok.Value,
 			Start: sNode.Tok.Start,
 			End:   sNode.Tok.End,
+
+			StartRune: sNode.Tok.StartRune,
+			EndRune:   sNode.Tok.EndRune,
 		}
 		return newAstSinNode(t)
 	case astUnNodeName:
@@ -33,6 +36,9 @@ func DeepCopyAstNode(node AstNode) AstNode {
 			Value: sNode.Tok.Value,
 			Start: sNode.Tok.Start,
 			End:   sNode.Tok.End,
+
+			StartRune: sNode.Tok.StartRune,
+			EndRune:   sNode.Tok.EndRune,
 		}
 		child := DeepCopyAstNode(sNode.Node)
 		return newAstUnNode(t, child)
@@ -43,6 +49,9 @@ func DeepCopyAstNode(node AstNode) AstNode {
 			Value: sNode.Tok.Value,
 			Start: sNode.Tok.Start,
 			End:   sNode.Tok.End,
+
+			StartRune: sNode.Tok.StartRune,
+			EndRune:   sNode.Tok.EndRune,
 		}
 		lNode := DeepCopyAstNode(sNode.LNode)
 		RNode := DeepCopyAstNode(sNode.RNode)
@@ -54,6 +63,9 @@ func DeepCopyAstNode(node AstNode) AstNode {
 			Value: sNode.Tok.Value,
 			Start: sNode.Tok.Start,
 			End:   sNode.Tok.End,
+
+			StartRune: sNode.Tok.StartRune,
+			EndRune:   sNode.Tok.EndRune,
 		}
 		children := make([]AstNode, 0)
 		for _, c := range sNode.Nodes {
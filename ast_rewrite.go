@@ -0,0 +1,58 @@
+package formula_engine
+
+import "fmt"
+
+// Rewrite 后序遍历ast树，使用 f 的返回值代替各节点，返回新树，不修改原树。
+// 调用 f 时节点的子节点已被替换；f 返回nil时保留原节点，返回的节点不会再被遍历
+func Rewrite(node AstNode, f func(AstNode) AstNode) AstNode {
+	if node == nil {
+		return nil
+	}
+	return rewrite(DeepCopyAstNode(node), f)
+}
+
+// rewrite 原地替换子节点
+func rewrite(node AstNode, f func(AstNode) AstNode) AstNode {
+	switch n := node.(type) {
+	case *astUnNode:
+		n.Node = rewrite(n.Node, f)
+	case *astBinNode:
+		n.LNode = rewrite(n.LNode, f)
+		n.RNode = rewrite(n.RNode, f)
+	case *astGeneralNode:
+		for idx, c := range n.Nodes {
+			n.Nodes[idx] = rewrite(c, f)
+		}
+	}
+	if res := f(node); res != nil {
+		return res
+	}
+	return node
+}
+
+// SubstituteVariable 将变量name替换为replacement，如将 {net} 替换为 {gross}-{tax}。
+// 每处替换使用replacement的副本，格式化时按优先级自动添加括号。replacement 为nil时返回错误
+func SubstituteVariable(node AstNode, name string, replacement AstNode) (AstNode, error) {
+	if replacement == nil {
+		return nil, makeErr(illegalSyntaxErrMsg, fmt.Sprintf("Replacement of variable %q must not be nil", name))
+	}
+	return Rewrite(node, func(n AstNode) AstNode {
+		if tok := n.GetTok(); n.GetName() == astSinNodeName && tok.Type == TTIdentifier && tok.Value == name {
+			return DeepCopyAstNode(replacement)
+		}
+		return nil
+	}), nil
+}
+
+// RenameVariable 将变量old重命名为new，保留源码位置。new 与 Var 的校验相同，不合法时返回错误
+func RenameVariable(node AstNode, old, new string) (AstNode, error) {
+	if err := checkVarName(new); err != nil {
+		return nil, err
+	}
+	return Rewrite(node, func(n AstNode) AstNode {
+		if tok := n.GetTok(); n.GetName() == astSinNodeName && tok.Type == TTIdentifier && tok.Value == old {
+			tok.Value = new
+		}
+		return nil
+	}), nil
+}
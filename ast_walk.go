@@ -0,0 +1,83 @@
+package formula_engine
+
+// Visitor ast树的访问者。Visit 返回nil时不再访问该节点的子节点，否则使用返回的访问者访问子节点
+type Visitor interface {
+	Visit(node AstNode) (w Visitor)
+}
+
+// Children 返回节点的子节点，按从左到右的顺序
+func Children(node AstNode) []AstNode {
+	switch n := node.(type) {
+	case *astUnNode:
+		return []AstNode{n.Node}
+	case *astBinNode:
+		return []AstNode{n.LNode, n.RNode}
+	case *astGeneralNode:
+		return n.Nodes
+	}
+	return nil
+}
+
+// Walk 深度优先、先序遍历ast树
+func Walk(node AstNode, v Visitor) {
+	if node == nil {
+		return
+	}
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	for _, c := range Children(node) {
+		Walk(c, v)
+	}
+}
+
+// astDepth ast树的深度，单个节点为1
+func astDepth(node AstNode) int {
+	depth := 0
+	for _, c := range Children(node) {
+		if d := astDepth(c); d > depth {
+			depth = d
+		}
+	}
+	return depth + 1
+}
+
+// inspector 将函数适配为 Visitor
+type inspector func(AstNode) bool
+
+func (f inspector) Visit(node AstNode) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect 深度优先、先序遍历ast树，f 返回false时不再访问该节点的子节点
+func Inspect(node AstNode, f func(AstNode) bool) {
+	Walk(node, inspector(f))
+}
+
+// Variables 返回公式引用的变量名，去重，按首次出现的顺序
+func Variables(node AstNode) []string {
+	return collectTokValues(node, TTIdentifier)
+}
+
+// Functions 返回公式调用的函数名，去重，按首次出现的顺序
+func Functions(node AstNode) []string {
+	return collectTokValues(node, TTFunction)
+}
+
+// collectTokValues 收集指定类型token的值
+func collectTokValues(node AstNode, type_ TT) []string {
+	values := make([]string, 0)
+	seen := make(map[string]bool)
+	Inspect(node, func(n AstNode) bool {
+		tok := n.GetTok()
+		if tok.Type == type_ && !seen[tok.Value] {
+			seen[tok.Value] = true
+			values = append(values, tok.Value)
+		}
+		return true
+	})
+	return values
+}
@@ -1,175 +1,291 @@
 package formula_engine
 
 import (
+	"context"
 	"fmt"
-	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
+	"strings"
 )
 
-// convertBool 将bool值转化为Decimal类型。0为假，1为真
-func convertBool(p bool) decimal.Decimal {
-	if p {
-		return decimal.NewFromInt(1)
-	} else {
-		return decimal.Zero
+// arith 算术运算通用处理：空值、错误值传递，非数字报错
+func arith(p1 Value, p2 Value, f func(d1 decimal.Decimal, d2 decimal.Decimal) (decimal.Decimal, error)) (Value, error) {
+	if res, ok := propagate(p1, p2); ok {
+		return res, nil
 	}
-}
-
-// convertToBool 将Decimal值转化为bool类型。0为假，1为真
-func convertToBool(p *decimal.Decimal) bool {
-	if p.Equal(decimal.Zero) {
-		return false
-	} else {
-		return true
+	d1, err := toNumber(p1)
+	if err != nil {
+		return Value{}, err
+	}
+	d2, err := toNumber(p2)
+	if err != nil {
+		return Value{}, err
+	}
+	res, err := f(d1, d2)
+	if err != nil {
+		return Value{}, err
 	}
+	return NumberValue(res), nil
 }
 
-// checkParNum 函数计算前进行参数个数校验
-func checkParNum(parNum int, length int) error {
-	switch parNum {
-	case Abt:
-		return nil
-	case GtZero:
-		if length == 0 {
-			return makeErr(illegalSyntaxErrMsg, fmt.Sprintf("Required Greater than 0 params,but got %d.\n", length))
-		}
-	default:
-		if parNum != length {
-			return makeErr(illegalSyntaxErrMsg, fmt.Sprintf("Required %d params,but got %d.\n", parNum, length))
+// compare 比较运算通用处理：空值、错误值传递，字符串之间按字典序比较，f 的参数为 p1 与 p2 的比较结果（-1、0、1）
+func compare(p1 Value, p2 Value, f func(c int) bool) (Value, error) {
+	if res, ok := propagate(p1, p2); ok {
+		return res, nil
+	}
+	if p1.kind == KindString || p2.kind == KindString {
+		if p1.kind != p2.kind {
+			return Value{}, newEvalErr(typeErrMsg, fmt.Sprintf("Cannot compare %s with %s", p1.kind, p2.kind))
 		}
+		return BoolValue(f(strings.Compare(p1.str, p2.str))), nil
+	}
+	d1, err := toComparable(p1)
+	if err != nil {
+		return Value{}, err
 	}
-	return nil
+	d2, err := toComparable(p2)
+	if err != nil {
+		return Value{}, err
+	}
+	return BoolValue(f(d1.Cmp(d2))), nil
 }
 
-// plus 加
-func plus(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	res := p1.Add(*p2)
-	return &res, nil
+// plus 加，两个字符串相加时拼接
+func plus(p1 Value, p2 Value) (Value, error) {
+	if p1.kind == KindString && p2.kind == KindString {
+		return StringValue(p1.str + p2.str), nil
+	}
+	return arith(p1, p2, func(d1 decimal.Decimal, d2 decimal.Decimal) (decimal.Decimal, error) {
+		return d1.Add(d2), nil
+	})
 }
 
 // minus 减
-func minus(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	res := p1.Sub(*p2)
-	return &res, nil
+func minus(p1 Value, p2 Value) (Value, error) {
+	return arith(p1, p2, func(d1 decimal.Decimal, d2 decimal.Decimal) (decimal.Decimal, error) {
+		return d1.Sub(d2), nil
+	})
 }
 
-// unPlusOrMinus 处理 +1 ++1 类似情况
-func unPlus(p *decimal.Decimal) (*decimal.Decimal, error) {
+// unPlus 处理 +1 ++1 类似情况
+func unPlus(p Value) (Value, error) {
+	if res, ok := propagate(p); ok {
+		return res, nil
+	}
+	if _, err := toNumber(p); err != nil {
+		return Value{}, err
+	}
 	return p, nil
 }
 
-// unPlusOrMinus 处理 -1 --1 类似情况
-func unMinus(p *decimal.Decimal) (*decimal.Decimal, error) {
-	res := p.Mul(decimal.NewFromInt(-1))
-	return &res, nil
+// unMinus 处理 -1 --1 类似情况
+func unMinus(p Value) (Value, error) {
+	if res, ok := propagate(p); ok {
+		return res, nil
+	}
+	d, err := toNumber(p)
+	if err != nil {
+		return Value{}, err
+	}
+	return NumberValue(d.Neg()), nil
+}
+
+// percent 百分号 5% 即 0.05
+func percent(p Value) (Value, error) {
+	if res, ok := propagate(p); ok {
+		return res, nil
+	}
+	d, err := toNumber(p)
+	if err != nil {
+		return Value{}, err
+	}
+	return NumberValue(d.Shift(-2)), nil
 }
 
 // mul 乘
-func mul(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	res := p1.Mul(*p2)
-	return &res, nil
+func mul(p1 Value, p2 Value) (Value, error) {
+	return arith(p1, p2, func(d1 decimal.Decimal, d2 decimal.Decimal) (decimal.Decimal, error) {
+		return d1.Mul(d2), nil
+	})
 }
 
 // div 除
-func div(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	if p2.Equal(decimal.Zero) {
-		return nil, makeErr(illegalCalErrMsg, "Cannot divide by 0")
+func div(p1 Value, p2 Value) (Value, error) {
+	return arith(p1, p2, func(d1 decimal.Decimal, d2 decimal.Decimal) (decimal.Decimal, error) {
+		if d2.Equal(decimal.Zero) {
+			return decimal.Zero, newDivErr()
+		}
+		return d1.Div(d2), nil
+	})
+}
+
+// divRound 返回保留precision位小数的除法
+func divRound(precision int32) func(p1 Value, p2 Value) (Value, error) {
+	return func(p1 Value, p2 Value) (Value, error) {
+		return arith(p1, p2, func(d1 decimal.Decimal, d2 decimal.Decimal) (decimal.Decimal, error) {
+			if d2.Equal(decimal.Zero) {
+				return decimal.Zero, newDivErr()
+			}
+			return d1.DivRound(d2, precision), nil
+		})
 	}
-	res := p1.Div(*p2)
-	return &res, nil
 }
 
 // pow 乘方
-func pow(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	res := p1.Pow(*p2)
-	return &res, nil
+func pow(p1 Value, p2 Value) (Value, error) {
+	return arith(p1, p2, func(d1 decimal.Decimal, d2 decimal.Decimal) (decimal.Decimal, error) {
+		return d1.Pow(d2), nil
+	})
+}
+
+// powContext 可中断的乘方：正整数指数按平方求幂计算，每次相乘前检查 ctx，结果与 pow 相同
+func powContext(ctx context.Context, p1 Value, p2 Value) (Value, error) {
+	return arith(p1, p2, func(d1 decimal.Decimal, d2 decimal.Decimal) (decimal.Decimal, error) {
+		n := d2.IntPart()
+		if n <= 0 {
+			return d1.Pow(d2), nil
+		}
+		res, base := decimal.New(1, 0), d1
+		for {
+			if n&1 == 1 {
+				res = res.Mul(base)
+			}
+			if n >>= 1; n == 0 {
+				return res, nil
+			}
+			if err := ctx.Err(); err != nil {
+				return decimal.Zero, err
+			}
+			base = base.Mul(base)
+		}
+	})
 }
 
 // and 与
-func and(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	b1 := convertToBool(p1)
-	b2 := convertToBool(p2)
-	b := b1 && b2
-	res := convertBool(b)
-	return &res, nil
+func and(p1 Value, p2 Value) (Value, error) {
+	if res, ok := propagateErr(p1, p2); ok {
+		return res, nil
+	}
+	b1, err := toBool(p1)
+	if err != nil {
+		return Value{}, err
+	}
+	b2, err := toBool(p2)
+	if err != nil {
+		return Value{}, err
+	}
+	return BoolValue(b1 && b2), nil
 }
 
 // or 或
-func or(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	b1 := convertToBool(p1)
-	b2 := convertToBool(p2)
-	b := b1 || b2
-	res := convertBool(b)
-	return &res, nil
+func or(p1 Value, p2 Value) (Value, error) {
+	if res, ok := propagateErr(p1, p2); ok {
+		return res, nil
+	}
+	b1, err := toBool(p1)
+	if err != nil {
+		return Value{}, err
+	}
+	b2, err := toBool(p2)
+	if err != nil {
+		return Value{}, err
+	}
+	return BoolValue(b1 || b2), nil
+}
+
+// shortCircuit 判断 & | 是否可以只根据左侧的值得出结果
+func shortCircuit(type_ TT, left Value) (Value, bool, error) {
+	if type_ != TTAnd && type_ != TTOr {
+		return Value{}, false, nil
+	}
+	if res, ok := propagateErr(left); ok {
+		return res, true, nil
+	}
+	b, err := toBool(left)
+	if err != nil {
+		return Value{}, false, err
+	}
+	switch {
+	case type_ == TTAnd && !b:
+		return BoolValue(false), true, nil
+	case type_ == TTOr && b:
+		return BoolValue(true), true, nil
+	}
+	return Value{}, false, nil
+}
+
+// shortCircuit 同 shortCircuit，运算符被 WithBinaryOperator 替换后不短路
+func (e *Engine) shortCircuit(type_ TT, left Value) (Value, bool, error) {
+	if !e.shortCircuitOps[type_] {
+		return Value{}, false, nil
+	}
+	return shortCircuit(type_, left)
 }
 
 // not 非
-func not(p *decimal.Decimal) (*decimal.Decimal, error) {
-	b := convertToBool(p)
-	b = !b
-	res := convertBool(b)
-	return &res, nil
+func not(p Value) (Value, error) {
+	if res, ok := propagateErr(p); ok {
+		return res, nil
+	}
+	b, err := toBool(p)
+	if err != nil {
+		return Value{}, err
+	}
+	return BoolValue(!b), nil
 }
 
 // eq 等于
-func eq(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	b := p1.Equal(*p2)
-	res := convertBool(b)
-	return &res, nil
+func eq(p1 Value, p2 Value) (Value, error) {
+	return compare(p1, p2, func(c int) bool { return c == 0 })
 }
 
 // neq 不等于
-func neq(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	b := p1.Equal(*p2)
-	res := convertBool(!b)
-	return &res, nil
+func neq(p1 Value, p2 Value) (Value, error) {
+	return compare(p1, p2, func(c int) bool { return c != 0 })
 }
 
 // gt 大于
-func gt(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	b := p1.GreaterThan(*p2)
-	res := convertBool(b)
-	return &res, nil
+func gt(p1 Value, p2 Value) (Value, error) {
+	return compare(p1, p2, func(c int) bool { return c > 0 })
 }
 
 // lt 小于
-func lt(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	b := p1.LessThan(*p2)
-	res := convertBool(b)
-	return &res, nil
+func lt(p1 Value, p2 Value) (Value, error) {
+	return compare(p1, p2, func(c int) bool { return c < 0 })
 }
 
 // gte 大于等于
-func gte(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	b := p1.GreaterThanOrEqual(*p2)
-	res := convertBool(b)
-	return &res, nil
+func gte(p1 Value, p2 Value) (Value, error) {
+	return compare(p1, p2, func(c int) bool { return c >= 0 })
 }
 
 // lte 小于等于
-func lte(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error) {
-	b := p1.LessThanOrEqual(*p2)
-	res := convertBool(b)
-	return &res, nil
+func lte(p1 Value, p2 Value) (Value, error) {
+	return compare(p1, p2, func(c int) bool { return c <= 0 })
 }
 
-// function 函数
-func function(funcName string, ps ...*decimal.Decimal) (*decimal.Decimal, error) {
-	parNum, ok := FuncParNumMap[funcName]
+// function 函数。惰性函数直接传入args，否则按顺序计算所有参数后调用，参数中有错误值时直接返回该错误值
+func function(e *Engine, funcName string, args ...Thunk) (Value, error) {
+	spec, ok := e.lookupFunc(funcName)
 	if !ok {
-		return nil, makeErr(illegalCharErrMsg, fmt.Sprintf("UnKnow function name %s in FuncParNumMap", funcName))
+		return Value{}, newEvalErr(illegalCalErrMsg, fmt.Sprintf("UnKnow function name %s", funcName))
 	}
-	err := checkParNum(parNum, len(ps))
+	err := spec.checkArgs(funcName, len(args))
 	if err != nil {
-		return nil, errors.Wrapf(err, fmt.Sprintf("Function name: %s", funcName))
+		return Value{}, err
 	}
-	fun, ok := FuncMap[funcName]
-	if !ok {
-		return nil, makeErr(illegalCharErrMsg, fmt.Sprintf("UnKnow function name %s in FuncMap", funcName))
+	if spec.Lazy != nil {
+		return spec.Lazy(args...)
 	}
-	res, err := fun(ps...)
-	if err != nil {
-		return nil, err
+	ps := make([]Value, 0, len(args))
+	for _, arg := range args {
+		p, err := arg()
+		if err != nil {
+			return Value{}, err
+		}
+		if res, ok := propagateErr(p); ok {
+			return res, nil
+		}
+		ps = append(ps, p)
 	}
-	return res, nil
+	return spec.Impl(ps...)
 }
@@ -0,0 +1,279 @@
+package formula_engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/shopspring/decimal"
+)
+
+// column 一列计算结果，vals[i]、errs[i] 为第i行的值和错误
+type column struct {
+	vals []Value
+	errs []error
+}
+
+// batch 按列计算，每个节点对整批数据只访问一次
+type batch struct {
+	engine  *Engine
+	columns map[string][]decimal.Decimal
+	rows    int
+	config  *evalConfig
+	free    []column // 可复用的列缓冲
+}
+
+// EvaluateColumns 按列计算公式，返回每一行的值和错误，某一行出错不影响其他行，出错的行的值为空值。
+// 行数为最长的列的长度，较短的列缺少的行视为变量不存在，按 EvalOption 中的 MissingPolicy 处理。
+// 每个节点只对需要计算的行计算：& | 的右侧只计算未短路的行，函数的参数在前一个参数出错的行不再计算，
+// 惰性函数（如 IF、AND）对需要计算的行逐行计算，结果及副作用与逐行计算一致。
+// 不支持计算限制（WithMaxSteps 等）及 WithResolver，使用时每一行均返回错误。函数在计算时从Engine获取
+func EvaluateColumns(f *Formula, columns map[string][]decimal.Decimal, opts ...EvalOption) ([]Value, []error) {
+	b := &batch{
+		engine:  f.engine,
+		columns: columns,
+		config:  newEvalConfig(opts...),
+	}
+	for _, col := range columns {
+		if len(col) > b.rows {
+			b.rows = len(col)
+		}
+	}
+	if b.config.limited() || b.config.resolver != nil {
+		col := b.alloc()
+		b.fillErr(col, newEvalErr(illegalCalErrMsg, "EvaluateColumns does not support evaluation limits or resolvers"))
+		return col.vals, col.errs
+	}
+	res := b.eval(f.root, nil)
+	for i, err := range res.errs {
+		if err != nil {
+			res.vals[i] = NullValue()
+		}
+	}
+	return res.vals, res.errs
+}
+
+// active 第i行是否需要计算，mask 为nil时计算所有行
+func active(mask []bool, i int) bool {
+	return mask == nil || mask[i]
+}
+
+// alloc 获取列缓冲，优先复用已释放的缓冲。返回的缓冲值均为空值，错误均为nil
+func (b *batch) alloc() column {
+	if n := len(b.free); n > 0 {
+		col := b.free[n-1]
+		b.free = b.free[:n-1]
+		for i := range col.errs {
+			col.vals[i], col.errs[i] = Value{}, nil
+		}
+		return col
+	}
+	return column{vals: make([]Value, b.rows), errs: make([]error, b.rows)}
+}
+
+// release 释放列缓冲
+func (b *batch) release(cols ...column) {
+	b.free = append(b.free, cols...)
+}
+
+// eval 计算节点，只计算 mask 中的行（mask 为nil时计算所有行），其他行为空值。mask 只在调用期间使用
+func (b *batch) eval(node AstNode, mask []bool) column {
+	tok := node.GetTok()
+	switch node.GetName() {
+	case astSinNodeName:
+		return b.evalSin(tok, mask)
+	case astUnNodeName:
+		if tok.Type == TTIllegal {
+			col := b.alloc()
+			b.fillErr(col, illegalNodeErr(tok))
+			return col
+		}
+		col := b.eval(node.(*astUnNode).Node, mask)
+		fun, ok := b.engine.unVisMap[tok.Type]
+		for i := 0; i < b.rows; i++ {
+			if !active(mask, i) || col.errs[i] != nil {
+				continue
+			}
+			if !ok {
+				col.errs[i] = makeErrWithToken(tok, systemErrMsg, fmt.Sprintf("UnKnow Unary type %s", tok.Type))
+				continue
+			}
+			res, err := fun(col.vals[i])
+			col.vals[i], col.errs[i] = res, locate(err, tok)
+		}
+		return col
+	case astBinNodeName:
+		return b.evalBin(node.(*astBinNode), mask)
+	case astGeneralNodeName:
+		return b.evalGeneral(node.(*astGeneralNode), mask)
+	}
+	col := b.alloc()
+	b.fillErr(col, makeErrWithToken(tok, systemErrMsg, fmt.Sprintf("UnKnow node type %s", node.GetName())))
+	return col
+}
+
+// evalSin 计算单节点
+func (b *batch) evalSin(tok *token, mask []bool) column {
+	col := b.alloc()
+	switch tok.Type {
+	case TTIdentifier:
+		data, ok := b.columns[tok.Value]
+		for i := 0; i < b.rows; i++ {
+			if !active(mask, i) {
+				continue
+			}
+			if ok && i < len(data) {
+				col.vals[i] = NumberValue(data[i])
+			} else {
+				col.vals[i], col.errs[i] = b.config.missingValue(tok, nil)
+			}
+		}
+	case TTNum:
+		dec, err := decimal.NewFromString(tok.Value)
+		if err != nil {
+			b.fillErr(col, makeErrWithToken(tok, systemErrMsg, err.Error()))
+			break
+		}
+		b.fill(col, NumberValue(dec))
+	case TTString:
+		b.fill(col, StringValue(tok.Value))
+	default:
+		b.fillErr(col, illegalNodeErr(tok))
+	}
+	return col
+}
+
+// evalBin 计算二叉节点，结果写入左侧的列缓冲。右侧只计算左侧未出错且未短路的行
+func (b *batch) evalBin(node *astBinNode, mask []bool) column {
+	tok := node.Tok
+	left := b.eval(node.LNode, mask)
+	rmask := make([]bool, b.rows)
+	for i := 0; i < b.rows; i++ {
+		if !active(mask, i) || left.errs[i] != nil {
+			continue
+		}
+		res, short, err := b.engine.shortCircuit(tok.Type, left.vals[i])
+		switch {
+		case err != nil:
+			left.errs[i] = withTok(err, tok)
+		case short:
+			left.vals[i] = res
+		default:
+			rmask[i] = true
+		}
+	}
+	right := b.eval(node.RNode, rmask)
+	fun, ok := b.engine.binVisMap[tok.Type]
+	for i := 0; i < b.rows; i++ {
+		switch {
+		case !rmask[i]:
+		case right.errs[i] != nil:
+			left.errs[i] = right.errs[i]
+		case !ok:
+			left.errs[i] = makeErrWithToken(tok, systemErrMsg, fmt.Sprintf("UnKnow Binary type %s", tok.Type))
+		default:
+			res, err := fun(left.vals[i], right.vals[i])
+			left.vals[i], left.errs[i] = res, locate(err, tok)
+		}
+	}
+	b.release(right)
+	return left
+}
+
+// evalGeneral 计算函数节点。参数依次计算，前一个参数出错的行不再计算之后的参数；惰性函数逐行计算
+func (b *batch) evalGeneral(node *astGeneralNode, mask []bool) column {
+	tok := node.Tok
+	spec, ok := b.engine.lookupFunc(tok.Value)
+	if ok && spec.Lazy != nil {
+		return b.evalRows(node, mask)
+	}
+	col := b.alloc()
+	if !ok {
+		b.fillErr(col, makeErrWithToken(tok, illegalSyntaxErrMsg, fmt.Sprintf("UnKnow function name %s", tok.Value)))
+		return col
+	}
+	if err := spec.checkArgs(tok.Value, len(node.Nodes)); err != nil {
+		b.fillErr(col, withTok(err, tok))
+		return col
+	}
+
+	amask := make([]bool, b.rows)
+	for i := range amask {
+		amask[i] = active(mask, i)
+	}
+	args := make([]column, 0, len(node.Nodes))
+	defer func() { b.release(args...) }()
+	for _, n := range node.Nodes {
+		arg := b.eval(n, amask)
+		args = append(args, arg)
+		for i := 0; i < b.rows; i++ {
+			if amask[i] && arg.errs[i] != nil {
+				col.errs[i], amask[i] = arg.errs[i], false
+			}
+		}
+	}
+
+	ps := make([]Value, len(args))
+	for i := 0; i < b.rows; i++ {
+		if !amask[i] {
+			continue
+		}
+		for idx, arg := range args {
+			ps[idx] = arg.vals[i]
+		}
+		if res, ok := propagateErr(ps...); ok {
+			col.vals[i] = res
+			continue
+		}
+		res, err := spec.Impl(ps...)
+		col.vals[i], col.errs[i] = res, locate(err, tok)
+	}
+	return col
+}
+
+// evalRows 逐行计算节点，变量取自当前行，用于惰性函数：每一行只计算被选中的参数
+func (b *batch) evalRows(node AstNode, mask []bool) column {
+	col := b.alloc()
+	fn, err := b.engine.compile(node)
+	if err != nil {
+		b.fillErr(col, err)
+		return col
+	}
+	r := &rowResolver{columns: b.columns}
+	config := *b.config
+	config.resolver = r
+	s := &evalScope{config: &config}
+	for ; r.row < b.rows; r.row++ {
+		if active(mask, r.row) {
+			col.vals[r.row], col.errs[r.row] = fn(s)
+		}
+	}
+	return col
+}
+
+// rowResolver 获取某一行的变量值，该行缺少的变量返回 ErrNotFound
+type rowResolver struct {
+	columns map[string][]decimal.Decimal
+	row     int
+}
+
+// Resolve 获取当前行的变量值
+func (r *rowResolver) Resolve(_ context.Context, name string) (Value, error) {
+	data, ok := r.columns[name]
+	if !ok || r.row >= len(data) {
+		return Value{}, ErrNotFound
+	}
+	return NumberValue(data[r.row]), nil
+}
+
+// fill 整列填充同一个值
+func (b *batch) fill(col column, v Value) {
+	for i := range col.vals {
+		col.vals[i] = v
+	}
+}
+
+// fillErr 整列填充同一个错误
+func (b *batch) fillErr(col column, err error) {
+	for i := range col.errs {
+		col.errs[i] = err
+	}
+}
@@ -0,0 +1,132 @@
+package formula_engine
+
+import (
+	"context"
+	"sync"
+)
+
+// Engine 公式引擎。每个Engine拥有独立的函数表、运算符表及配置，
+// 不同Engine之间互不影响，可用于同一进程内多租户使用不同的函数集合。
+type Engine struct {
+	mu sync.RWMutex
+	// 函数表，函数名 => 函数定义，读写需加锁
+	funcs map[string]FuncSpec
+	// 该map能够通过TT类型决定访问哪个一元计算方法
+	unVisMap map[TT]func(p Value) (Value, error)
+	// 该map能够通过TT类型决定访问哪个二元计算方法
+	binVisMap map[TT]func(p1 Value, p2 Value) (Value, error)
+	// 可中断的二元计算方法，计算可取消时代替 binVisMap 中的同类方法；替换运算符后不再使用
+	ctxBinVisMap map[TT]func(ctx context.Context, p1 Value, p2 Value) (Value, error)
+
+	// 短路求值的运算符（& |），替换后不再短路，替换的方法总是得到两侧的值
+	shortCircuitOps map[TT]bool
+
+	noBuiltinFuncs bool // 不加载内置函数
+	customOps      bool // 是否替换过运算符，替换后优化时不再化简依赖运算符语义的恒等式
+}
+
+// Option Engine配置项
+type Option func(e *Engine)
+
+// WithFunc 添加函数，同名内置函数会被覆盖。函数定义不合法时panic
+func WithFunc(name string, spec FuncSpec) Option {
+	return func(e *Engine) {
+		if err := e.RegisterFunction(name, spec); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// WithoutBuiltinFuncs 不加载内置函数（MAX、MIN、IF等），只使用 WithFunc 添加的函数
+func WithoutBuiltinFuncs() Option {
+	return func(e *Engine) {
+		e.noBuiltinFuncs = true
+	}
+}
+
+// WithUnaryOperator 替换一元运算符的计算方法
+func WithUnaryOperator(type_ TT, fun func(p Value) (Value, error)) Option {
+	return func(e *Engine) {
+		e.unVisMap[type_] = fun
+		e.customOps = true
+	}
+}
+
+// WithBinaryOperator 替换二元运算符的计算方法。替换 & | 后不再短路求值：总是计算两侧，由 fun 决定结果
+func WithBinaryOperator(type_ TT, fun func(p1 Value, p2 Value) (Value, error)) Option {
+	return func(e *Engine) {
+		e.binVisMap[type_] = fun
+		delete(e.ctxBinVisMap, type_)
+		delete(e.shortCircuitOps, type_)
+		e.customOps = true
+	}
+}
+
+// WithDivisionPrecision 设置除法结果保留的小数位数，默认使用 decimal.DivisionPrecision
+func WithDivisionPrecision(precision int32) Option {
+	return func(e *Engine) {
+		e.binVisMap[TTDiv] = divRound(precision)
+	}
+}
+
+// NewEngine 创建Engine。默认加载 builtinFuncs 中的内置函数
+func NewEngine(opts ...Option) *Engine {
+	e := &Engine{
+		funcs:     make(map[string]FuncSpec),
+		unVisMap:  newUnVisMap(),
+		binVisMap: newBinVisMap(),
+		ctxBinVisMap: map[TT]func(ctx context.Context, p1 Value, p2 Value) (Value, error){
+			TTPow: powContext,
+		},
+		shortCircuitOps: map[TT]bool{TTAnd: true, TTOr: true},
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if !e.noBuiltinFuncs {
+		for name, spec := range builtinFuncs {
+			if _, ok := e.funcs[name]; ok {
+				continue
+			}
+			e.funcs[name] = spec
+		}
+	}
+	return e
+}
+
+// defaultEngine 包级函数使用的默认Engine
+var defaultEngine = NewEngine()
+
+// DefaultEngine 返回包级函数使用的默认Engine
+func DefaultEngine() *Engine {
+	return defaultEngine
+}
+
+// newUnVisMap 默认一元运算符表
+func newUnVisMap() map[TT]func(p Value) (Value, error) {
+	return map[TT]func(p Value) (Value, error){
+		TTPlus:    unPlus,
+		TTMinus:   unMinus,
+		TTNot:     not,
+		TTPercent: percent,
+	}
+}
+
+// newBinVisMap 默认二元运算符表
+func newBinVisMap() map[TT]func(p1 Value, p2 Value) (Value, error) {
+	return map[TT]func(p1 Value, p2 Value) (Value, error){
+		TTPlus:  plus,
+		TTMinus: minus,
+		TTMul:   mul,
+		TTDiv:   div,
+		TTPow:   pow,
+		TTAnd:   and,
+		TTOr:    or,
+		TTEq:    eq,
+		TTNeq:   neq,
+		TTGt:    gt,
+		TTGte:   gte,
+		TTLt:    lt,
+		TTLte:   lte,
+	}
+}
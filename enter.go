@@ -1,16 +1,108 @@
 package formula_engine
 
-import "github.com/shopspring/decimal"
+import (
+	"context"
+	"github.com/shopspring/decimal"
+	"sort"
+)
 
+// GetAstTreeByString 使用默认Engine解析字符串，返回ast根节点
 func GetAstTreeByString(str string) (AstNode, error) {
-	tokens, err := newLexer(str).MakeTokens()
+	return defaultEngine.GetAstTreeByString(str)
+}
+
+// ParseWithRecovery 使用默认Engine容错解析字符串
+func ParseWithRecovery(str string) (AstNode, []error) {
+	return defaultEngine.ParseWithRecovery(str)
+}
+
+// CalByAstTree 使用默认Engine计算ast树
+func CalByAstTree(node AstNode, identifierMap map[string]string, opts ...EvalOption) (*decimal.Decimal, error) {
+	return defaultEngine.CalByAstTree(node, identifierMap, opts...)
+}
+
+// CalValueByAstTree 使用默认Engine计算ast树，返回带类型的值
+func CalValueByAstTree(node AstNode, identifierMap map[string]string, opts ...EvalOption) (Value, error) {
+	return defaultEngine.CalValueByAstTree(node, identifierMap, opts...)
+}
+
+// CalValueByData 使用默认Engine计算ast树，变量按路径从嵌套数据中获取
+func CalValueByData(node AstNode, data any, opts ...EvalOption) (Value, error) {
+	return defaultEngine.CalValueByData(node, data, opts...)
+}
+
+// CalValueByResolver 使用默认Engine计算ast树，变量通过 Resolver 获取
+func CalValueByResolver(ctx context.Context, node AstNode, r Resolver, opts ...EvalOption) (Value, error) {
+	return defaultEngine.CalValueByResolver(ctx, node, r, opts...)
+}
+
+// EvalContext 使用默认Engine计算ast树，计算中检查 ctx 是否已取消或超时
+func EvalContext(ctx context.Context, node AstNode, identifierMap map[string]string, opts ...EvalOption) (Value, error) {
+	return defaultEngine.EvalContext(ctx, node, identifierMap, opts...)
+}
+
+// GetAstTreeByString 解析字符串，返回ast根节点
+func (e *Engine) GetAstTreeByString(str string) (AstNode, error) {
+	tokens, err := newLexer(str, e).MakeTokens()
 	if err != nil {
 		return nil, err
 	}
-	return newParser(tokens).Parse()
+	return newParser(tokens, e).Parse()
+}
+
+// ParseWithRecovery 容错解析，一次返回所有词法、语法错误（按位置排序）及部分ast树。
+// 出错的部分使用非法节点代替；有错误时根节点为包裹部分ast树的非法节点，原文为整个公式，计算、编译时均报错。
+// 没有错误时与 GetAstTreeByString 结果相同
+func (e *Engine) ParseWithRecovery(str string) (AstNode, []error) {
+	l := newLexer(str, e)
+	l.Recovering = true
+	tokens, _ := l.MakeTokens()
+	p := newParser(tokens, e)
+	p.Recovering = true
+	node, _ := p.Parse()
+	errs := append(l.Errs, p.Errs...)
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errSpan(errs[i]).Start < errSpan(errs[j]).Start
+	})
+	if len(errs) > 0 {
+		// 跳过的多余token、非法字符等不在树中，使用非法节点包裹根节点，保证计算时报错
+		node = newAstUnNode(l.newToken(TTIllegal, str, 0, len(str)-1), node)
+	}
+	return node, errs
+}
+
+// CalByAstTree 计算ast树，结果转化为Decimal类型：布尔为0、1，空值报错
+func (e *Engine) CalByAstTree(node AstNode, identifierMap map[string]string, opts ...EvalOption) (*decimal.Decimal, error) {
+	res, err := e.CalValueByAstTree(node, identifierMap, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return res.Decimal()
+}
+
+// CalValueByAstTree 计算ast树，返回带类型的值。结果可能为错误值，此时err为nil。
+// 计算不会修改ast树，同一ast树可被并发计算；需要反复计算时，使用 Compile 编译后计算更快
+func (e *Engine) CalValueByAstTree(node AstNode, identifierMap map[string]string, opts ...EvalOption) (Value, error) {
+	return newInterpreter(node, identifierMap, e, newEvalConfig(opts...)).Interpret()
+}
+
+// EvalContext 计算ast树，计算中检查 ctx 是否已取消或超时，返回 *LimitError。
+// 可使用 WithMaxSteps、WithMaxDepth、WithMaxDigits 限制计算，防止用户输入的公式长时间占用goroutine
+func (e *Engine) EvalContext(ctx context.Context, node AstNode, identifierMap map[string]string, opts ...EvalOption) (Value, error) {
+	config := newEvalConfig(opts...)
+	config.ctx = ctx
+	return newInterpreter(node, identifierMap, e, config).Interpret()
+}
+
+// CalValueByData 计算ast树，变量按路径从嵌套数据中获取，如 {order.customer.tier}、{items[2].qty}，路径规则见 ResolvePath。
+// 路径中的段不存在时按 MissingPolicy 处理，MissingError 时错误信息包含不存在的段
+func (e *Engine) CalValueByData(node AstNode, data any, opts ...EvalOption) (Value, error) {
+	return e.CalValueByResolver(context.Background(), node, NewDataResolver(data), opts...)
 }
 
-func CalByAstTree(node AstNode, identifierMap map[string]string) (*decimal.Decimal, error) {
-	cNode := DeepCopyAstNode(node)
-	return newInterpreter(cNode, identifierMap).Interpret()
+// CalValueByResolver 计算ast树，变量在计算到时才通过 Resolver 获取，未计算到的分支中的变量不会获取
+func (e *Engine) CalValueByResolver(ctx context.Context, node AstNode, r Resolver, opts ...EvalOption) (Value, error) {
+	config := newEvalConfig(opts...)
+	config.resolver, config.ctx = r, ctx
+	return newInterpreter(node, nil, e, config).Interpret()
 }
@@ -3,33 +3,221 @@ package formula_engine
 import (
 	"fmt"
 	"github.com/pkg/errors"
+	"strings"
 )
 
-// getTokPos 通过token获得位置信息
-func getTokPos(tok *token) string {
-	return fmt.Sprintf("Report at token:Type:%s,value:%s,start:%d,end:%d", tok.Type, tok.Value, tok.Start, tok.End)
+// Span 源码位置，均包含首尾
+type Span struct {
+	Start     int // 首字节偏移
+	End       int // 末字节偏移
+	StartRune int // 首字符的字符（rune）偏移，用于在界面上按字符定位
+	EndRune   int // 末字符的字符偏移
 }
 
-// makeErr 组装错误
+// ErrorInfo 错误的公共信息，被各类错误嵌入
+type ErrorInfo struct {
+	Kind      string // 错误类别，如 "Illegal Syntax"、"Illegal Calculation"
+	Msg       string // 错误详情
+	Span      Span   // 错误位置，Located 为 false 时无意义
+	Located   bool   // 是否已定位到源码位置
+	Token     string // 出错的token文本
+	TokenType TT     // 出错的token类型，词法错误时为空
+	Func      string // 出错的函数名，与函数无关时为空
+}
+
+// Error 错误信息
+func (i *ErrorInfo) Error() string {
+	var str strings.Builder
+	str.WriteString(fmt.Sprintf("err:%s:%s", i.Kind, i.Msg))
+	if i.Func != "" {
+		str.WriteString(fmt.Sprintf(",Function name: %s", i.Func))
+	}
+	if i.Located {
+		str.WriteString(",Report at token:")
+		if i.TokenType != "" {
+			str.WriteString(fmt.Sprintf("Type:%s,", i.TokenType))
+		}
+		str.WriteString(fmt.Sprintf("value:%s,start:%d,end:%d", i.Token, i.Span.Start, i.Span.End))
+	}
+	return str.String()
+}
+
+// info 获取公共信息，用于定位
+func (i *ErrorInfo) info() *ErrorInfo {
+	return i
+}
+
+// locate 使用token定位
+func (i *ErrorInfo) locate(tok *token) {
+	i.Span = tok.span()
+	i.Located = true
+	i.Token = tok.Value
+	i.TokenType = tok.Type
+}
+
+// LexError 词法错误，如非法字符、未闭合的字符串
+type LexError struct {
+	ErrorInfo
+}
+
+// SyntaxError 语法错误，如缺少括号、未知函数
+type SyntaxError struct {
+	ErrorInfo
+}
+
+// ArityError 函数参数个数错误，解析和计算时都会校验
+type ArityError struct {
+	ErrorInfo
+	MinArgs  int
+	MaxArgs  int
+	Variadic bool
+	Got      int // 实际参数个数
+}
+
+// EvalError 计算错误，如类型不匹配、变量不存在、函数执行失败
+type EvalError struct {
+	ErrorInfo
+	cause error
+}
+
+// Unwrap 返回函数实现返回的原始错误
+func (e *EvalError) Unwrap() error {
+	return e.cause
+}
+
+// DivisionByZeroError 除0错误
+type DivisionByZeroError struct {
+	ErrorInfo
+}
+
+// LimitKind 计算限制的类别
+type LimitKind string
+
+const (
+	LimitSteps   LimitKind = "steps"   // 步数，见 WithMaxSteps
+	LimitDepth   LimitKind = "depth"   // 嵌套深度，见 WithMaxDepth
+	LimitDigits  LimitKind = "digits"  // 中间结果的位数，见 WithMaxDigits
+	LimitContext LimitKind = "context" // context 被取消或超时
+)
+
+// LimitError 计算超出限制，或 context 被取消、超时。context 导致时可通过 errors.Is 判断 context.Canceled、context.DeadlineExceeded
+type LimitError struct {
+	ErrorInfo
+	Limit LimitKind
+	Max   int // 超出的限制值，context 导致时为0
+	cause error
+}
+
+// Unwrap 返回 context 的错误
+func (e *LimitError) Unwrap() error {
+	return e.cause
+}
+
+// PathError 按路径获取嵌套数据时出错，作为 EvalError 的原始错误，可通过 errors.As 获取
+type PathError struct {
+	Path     string // 完整路径，如 order.items[2].qty
+	Segment  string // 出错的段，如 items、[2]
+	NotFound bool   // 是否因为该段不存在：键不存在、下标越界或上一段为nil
+	Msg      string
+}
+
+// Error 错误信息
+func (e *PathError) Error() string {
+	if e.Segment == "" {
+		return fmt.Sprintf("Path '%s': %s", e.Path, e.Msg)
+	}
+	return fmt.Sprintf("Path '%s': %s at segment '%s'", e.Path, e.Msg, e.Segment)
+}
+
+// Unwrap 段不存在时为 ErrNotFound
+func (e *PathError) Unwrap() error {
+	if e.NotFound {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// locatable 可定位的错误
+type locatable interface {
+	error
+	info() *ErrorInfo
+	clone() locatable
+}
+
+// clone 浅拷贝，定位时不修改原错误
+func (e *LexError) clone() locatable            { c := *e; return &c }
+func (e *SyntaxError) clone() locatable         { c := *e; return &c }
+func (e *ArityError) clone() locatable          { c := *e; return &c }
+func (e *EvalError) clone() locatable           { c := *e; return &c }
+func (e *DivisionByZeroError) clone() locatable { c := *e; return &c }
+func (e *LimitError) clone() locatable          { c := *e; return &c }
+
+// withTok 使用token定位错误，返回定位后的副本，不修改原错误：函数返回的错误可能被多次计算共享。
+// 已定位的错误保持不变；非本包的错误及包装了未定位错误的错误包装为 EvalError。tok 为函数时，同时记录函数名
+func withTok(err error, tok *token) error {
+	var le locatable
+	switch {
+	case !errors.As(err, &le):
+		le = &EvalError{ErrorInfo: ErrorInfo{Kind: illegalCalErrMsg, Msg: err.Error()}, cause: err}
+	case le.info().Located:
+		return err
+	case error(le) == err:
+		le = le.clone()
+	default:
+		le = &EvalError{ErrorInfo: ErrorInfo{Kind: le.info().Kind, Msg: err.Error()}, cause: err}
+	}
+	info := le.info()
+	info.locate(tok)
+	if tok.Type == TTFunction && info.Func == "" {
+		info.Func = tok.Value
+	}
+	return le
+}
+
+// locate 错误不为nil时使用token定位
+func locate(err error, tok *token) error {
+	if err == nil {
+		return nil
+	}
+	return withTok(err, tok)
+}
+
+// errSpan 获取错误的位置，未定位的错误返回零值
+func errSpan(err error) Span {
+	var le locatable
+	if errors.As(err, &le) {
+		return le.info().Span
+	}
+	return Span{}
+}
+
+// makeErr 组装错误，用于与公式无关的错误，如函数定义不合法
 func makeErr(errName, details string) error {
 	message := fmt.Sprintf("err:%s:%s", errName, details)
 	return errors.New(message)
 }
 
-// makeStrErr 主要用于词法分析器报错
-func makeStrErr(idx int, str, errName, details string) error {
-	message := fmt.Sprintf("err:%s:%s,Report at :%s, index:%d\n", errName, details, str, idx)
-	return errors.New(message)
+// newEvalErr 组装计算错误，位置由 withTok 补充
+func newEvalErr(errName, details string) error {
+	return &EvalError{ErrorInfo: ErrorInfo{Kind: errName, Msg: details}}
 }
 
-// makeErrWithIdx 使用idx定位报错
-func makeErrWithIdx(idx int, errName, details string) error {
-	message := fmt.Sprintf("err:%s:%s,Report at index:%d\n", errName, details, idx)
-	return errors.New(message)
+// newDivErr 组装除0错误
+func newDivErr() error {
+	return &DivisionByZeroError{ErrorInfo: ErrorInfo{Kind: illegalCalErrMsg, Msg: "Cannot divide by 0"}}
+}
+
+// syntaxErrWithToken 使用token定位的语法错误，用于解码、构造ast树
+func syntaxErrWithToken(tok *token, details string) error {
+	return withTok(&SyntaxError{ErrorInfo: ErrorInfo{Kind: illegalSyntaxErrMsg, Msg: details}}, tok)
 }
 
-// makeErrWithToken 使用token定位报错
+// illegalNodeErr 计算、编译非法节点的错误
+func illegalNodeErr(tok *token) error {
+	return makeErrWithToken(tok, illegalSyntaxErrMsg, "Cannot calculate an illegal node, the formula has syntax errors")
+}
+
+// makeErrWithToken 使用token定位的计算错误
 func makeErrWithToken(tok *token, errName, details string) error {
-	message := fmt.Sprintf("err:%s:%s,Report at token:Type:%s,value:%s,start:%d,end:%d\n", errName, details, tok.Type, tok.Value, tok.Start, tok.End)
-	return errors.New(message)
+	return withTok(newEvalErr(errName, details), tok)
 }
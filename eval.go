@@ -0,0 +1,102 @@
+package formula_engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// MissingPolicy 变量不存在时的处理方式
+type MissingPolicy int
+
+const (
+	MissingZero  MissingPolicy = iota // 视为0（默认）
+	MissingError                      // 报错，错误信息包含变量的位置
+	MissingNull                       // 视为空值，空值在运算中向上传递
+)
+
+// evalConfig 单次计算的配置
+type evalConfig struct {
+	missing  MissingPolicy
+	defaults map[string]Value
+	resolver Resolver        // 不为nil时使用 resolver 获取变量的值，不使用 identifierMap
+	ctx      context.Context // 不为nil时计算中检查是否已取消
+
+	maxSteps  int // 计算限制，见 WithMaxSteps 等
+	maxDepth  int
+	maxDigits int
+	steps     int   // 已计算的步数
+	depth     int   // 当前深度
+	exceeded  error // 超出限制的错误
+}
+
+// EvalOption 单次计算的配置项
+type EvalOption func(c *evalConfig)
+
+// WithMissingVariable 设置变量不存在时的处理方式
+func WithMissingVariable(policy MissingPolicy) EvalOption {
+	return func(c *evalConfig) {
+		c.missing = policy
+	}
+}
+
+// WithVariableDefaults 设置变量的默认值，变量不存在时优先使用默认值，没有默认值时再按 MissingPolicy 处理
+func WithVariableDefaults(defaults map[string]Value) EvalOption {
+	return func(c *evalConfig) {
+		c.defaults = defaults
+	}
+}
+
+// newEvalConfig 组装计算配置
+func newEvalConfig(opts ...EvalOption) *evalConfig {
+	c := &evalConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// lookup 获取变量的值，变量不存在时按 missingValue 处理
+func (c *evalConfig) lookup(identifierMap map[string]string, tok *token) (Value, error) {
+	if c.resolver != nil {
+		return c.resolve(tok)
+	}
+	val, ok := identifierMap[tok.Value]
+	if !ok {
+		return c.missingValue(tok, nil)
+	}
+	return parseVarValue(val), nil
+}
+
+// resolve 使用 resolver 获取变量的值，返回 ErrNotFound 时按 missingValue 处理
+func (c *evalConfig) resolve(tok *token) (Value, error) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	val, err := c.resolver.Resolve(ctx, tok.Value)
+	if errors.Is(err, ErrNotFound) {
+		return c.missingValue(tok, err)
+	}
+	if err != nil {
+		return Value{}, withTok(err, tok)
+	}
+	return val, nil
+}
+
+// missingValue 变量不存在时，按默认值和 MissingPolicy 获取变量的值。cause 为变量不存在的具体原因，可为nil
+func (c *evalConfig) missingValue(tok *token, cause error) (Value, error) {
+	if val, ok := c.defaults[tok.Value]; ok {
+		return val, nil
+	}
+	switch c.missing {
+	case MissingError:
+		if cause != nil && cause != ErrNotFound {
+			return Value{}, withTok(cause, tok)
+		}
+		return Value{}, makeErrWithToken(tok, illegalCalErrMsg, fmt.Sprintf("Cannot found a value by key %s in IdentifierMap, please plus it.", tok.Value))
+	case MissingNull:
+		return NullValue(), nil
+	}
+	return parseVarValue(zeroStr), nil
+}
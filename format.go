@@ -0,0 +1,163 @@
+package formula_engine
+
+import (
+	"regexp"
+	"strings"
+)
+
+// 优先级，与 parser 的 BNF 对应，数字越大优先级越高
+const (
+	precOr = iota + 1
+	precAnd
+	precNot
+	precCompare
+	precPrimary   // + -
+	precSecondary // * /
+	precPow
+	precUnary   // 一元 + -，操作数为 factor
+	precPostfix // 后缀 %，操作数为 primary
+	precFactor  // 数字、字符串、变量、函数
+)
+
+// Format 将ast树格式化为规范的公式文本：只在需要时添加括号，函数名大写，二元运算符两侧、逗号后加空格。
+// 解析格式化的结果得到的ast树与原树结构相同
+func Format(node AstNode) string {
+	var str strings.Builder
+	writeNode(&str, node, 0)
+	return str.String()
+}
+
+// precedence 节点的优先级
+func precedence(node AstNode) int {
+	tok := node.GetTok()
+	switch node.GetName() {
+	case astUnNodeName:
+		switch tok.Type {
+		case TTNot:
+			return precNot
+		case TTIllegal:
+			return precFactor
+		case TTPercent:
+			return precPostfix
+		}
+		return precUnary
+	case astBinNodeName:
+		switch tok.Type {
+		case TTOr:
+			return precOr
+		case TTAnd:
+			return precAnd
+		case TTPlus, TTMinus:
+			return precPrimary
+		case TTMul, TTDiv:
+			return precSecondary
+		case TTPow:
+			return precPow
+		}
+		return precCompare
+	}
+	return precFactor
+}
+
+// writeNode 写入节点，节点优先级低于min时加括号
+func writeNode(str *strings.Builder, node AstNode, min int) {
+	if precedence(node) < min {
+		str.WriteByte('(')
+		writeNode(str, node, 0)
+		str.WriteByte(')')
+		return
+	}
+	tok := node.GetTok()
+	switch node.GetName() {
+	case astSinNodeName:
+		writeSin(str, tok)
+	case astUnNodeName:
+		switch tok.Type {
+		case TTIllegal:
+			// 容错解析的根节点，输出原文
+			str.WriteString(tok.Value)
+		case TTPercent:
+			writeNode(str, node.(*astUnNode).Node, precPostfix)
+			str.WriteString(opSymbols[tok.Type])
+		case TTNot:
+			str.WriteString(opSymbols[tok.Type])
+			writeNode(str, node.(*astUnNode).Node, precNot)
+		default:
+			str.WriteString(opSymbols[tok.Type])
+			writeNode(str, node.(*astUnNode).Node, precUnary)
+		}
+	case astBinNodeName:
+		n := node.(*astBinNode)
+		// 左右操作数所需的最低优先级：+ - * / 左结合，& | ^ 右结合，比较运算不能连用，^ 的左侧只能是 factor
+		prec := precedence(n)
+		left, right := prec, prec+1
+		switch prec {
+		case precOr, precAnd:
+			left, right = prec+1, prec
+		case precCompare:
+			left, right = prec+1, prec+1
+		case precPow:
+			left, right = precUnary, prec
+		}
+		writeNode(str, n.LNode, left)
+		str.WriteString(" " + opSymbols[tok.Type] + " ")
+		writeNode(str, n.RNode, right)
+	case astGeneralNodeName:
+		str.WriteString(strings.ToUpper(tok.Value))
+		str.WriteByte('(')
+		for idx, c := range node.(*astGeneralNode).Nodes {
+			if idx > 0 {
+				str.WriteString(", ")
+			}
+			writeNode(str, c, 0)
+		}
+		str.WriteByte(')')
+	}
+}
+
+// writeSin 写入单节点
+func writeSin(str *strings.Builder, tok *token) {
+	switch tok.Type {
+	case TTIdentifier:
+		str.WriteByte('{')
+		if isBareIdentifier(tok.Value) {
+			str.WriteString(tok.Value)
+		} else {
+			writeQuoted(str, tok.Value)
+		}
+		str.WriteByte('}')
+	case TTString:
+		writeQuoted(str, tok.Value)
+	default:
+		str.WriteString(tok.Value)
+	}
+}
+
+// writeQuoted 使用双引号包裹，必要时转义
+func writeQuoted(str *strings.Builder, s string) {
+	str.WriteByte('"')
+	for idx := 0; idx < len(s); idx++ {
+		switch c := s[idx]; c {
+		case '\\', '"':
+			str.WriteByte('\\')
+			str.WriteByte(c)
+		case '\n':
+			str.WriteString(`\n`)
+		case '\t':
+			str.WriteString(`\t`)
+		case '\r':
+			str.WriteString(`\r`)
+		default:
+			str.WriteByte(c)
+		}
+	}
+	str.WriteByte('"')
+}
+
+// bareIdentifier 不使用引号的变量名：由'.'分隔的各段以字母或'_'开头，由字母、数字、'_'组成，可带下标
+var bareIdentifier = regexp.MustCompile(`^[\p{L}_][\p{L}\p{Nd}_]*(\[[0-9]+\])*(\.[\p{L}_][\p{L}\p{Nd}_]*(\[[0-9]+\])*)*$`)
+
+// isBareIdentifier 变量名是否可以不使用引号
+func isBareIdentifier(name string) bool {
+	return bareIdentifier.MatchString(name)
+}
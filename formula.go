@@ -0,0 +1,292 @@
+package formula_engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/shopspring/decimal"
+)
+
+// compiledFn 编译后的计算方法
+type compiledFn func(s *evalScope) (Value, error)
+
+// evalScope 单次计算的变量及配置
+type evalScope struct {
+	identifierMap map[string]string
+	config        *evalConfig
+}
+
+// Formula 编译后的公式。函数、运算符在编译时绑定，计算时不再复制、修改ast树，可被多个goroutine并发计算
+type Formula struct {
+	str    string
+	root   AstNode
+	fn     compiledFn
+	engine *Engine
+}
+
+// Compile 使用默认Engine编译公式
+func Compile(str string) (*Formula, error) {
+	return defaultEngine.Compile(str)
+}
+
+// Compile 编译公式
+func (e *Engine) Compile(str string) (*Formula, error) {
+	node, err := e.GetAstTreeByString(str)
+	if err != nil {
+		return nil, err
+	}
+	f, err := e.compileFormula(node)
+	if err != nil {
+		return nil, err
+	}
+	f.str = str
+	return f, nil
+}
+
+// CompileAstTree 编译ast树，编译时复制ast树，之后修改node不影响编译结果
+func (e *Engine) CompileAstTree(node AstNode) (*Formula, error) {
+	return e.compileFormula(DeepCopyAstNode(node))
+}
+
+// compileFormula 编译ast树，node 由 Formula 独占
+func (e *Engine) compileFormula(node AstNode) (*Formula, error) {
+	fn, err := e.compile(node)
+	if err != nil {
+		return nil, err
+	}
+	return &Formula{root: node, fn: fn, engine: e}, nil
+}
+
+// Eval 计算公式，返回带类型的值。结果可能为错误值，此时err为nil
+func (f *Formula) Eval(identifierMap map[string]string, opts ...EvalOption) (Value, error) {
+	return f.run(&evalScope{identifierMap: identifierMap, config: newEvalConfig(opts...)})
+}
+
+// EvalContext 计算公式，计算中检查 ctx 是否已取消或超时，可使用 WithMaxSteps 等限制计算
+func (f *Formula) EvalContext(ctx context.Context, identifierMap map[string]string, opts ...EvalOption) (Value, error) {
+	config := newEvalConfig(opts...)
+	config.ctx = ctx
+	return f.run(&evalScope{identifierMap: identifierMap, config: config})
+}
+
+// EvalData 计算公式，变量按路径从嵌套数据中获取，见 Engine.CalValueByData
+func (f *Formula) EvalData(data any, opts ...EvalOption) (Value, error) {
+	return f.EvalResolver(context.Background(), NewDataResolver(data), opts...)
+}
+
+// EvalResolver 计算公式，变量在计算到时才通过 Resolver 获取
+func (f *Formula) EvalResolver(ctx context.Context, r Resolver, opts ...EvalOption) (Value, error) {
+	config := newEvalConfig(opts...)
+	config.resolver, config.ctx = r, ctx
+	return f.run(&evalScope{config: config})
+}
+
+// run 计算公式
+func (f *Formula) run(s *evalScope) (Value, error) {
+	return s.config.result(f.fn(s))
+}
+
+// EvalDecimal 计算公式，结果转化为Decimal类型：布尔为0、1，空值报错
+func (f *Formula) EvalDecimal(identifierMap map[string]string, opts ...EvalOption) (*decimal.Decimal, error) {
+	res, err := f.Eval(identifierMap, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return res.Decimal()
+}
+
+// String 公式原文，由 CompileAstTree 编译时为空
+func (f *Formula) String() string {
+	return f.str
+}
+
+// AstTree 返回ast树的副本
+func (f *Formula) AstTree() AstNode {
+	return DeepCopyAstNode(f.root)
+}
+
+// Variables 返回公式引用的变量名
+func (f *Formula) Variables() []string {
+	return Variables(f.root)
+}
+
+// compile 将ast树编译为闭包，有计算限制时检查限制
+func (e *Engine) compile(node AstNode) (compiledFn, error) {
+	fn, err := e.compileNode(node)
+	if err != nil {
+		return nil, err
+	}
+	tok := node.GetTok()
+	return func(s *evalScope) (Value, error) {
+		if !s.config.limited() {
+			return fn(s)
+		}
+		if err := s.config.enter(tok); err != nil {
+			return Value{}, err
+		}
+		res, err := fn(s)
+		s.config.leave()
+		if err != nil {
+			return Value{}, err
+		}
+		if err := s.config.checkDigits(res, tok); err != nil {
+			return Value{}, err
+		}
+		return res, nil
+	}, nil
+}
+
+// compileNode 将单个节点编译为闭包，子节点使用 compile 编译
+func (e *Engine) compileNode(node AstNode) (compiledFn, error) {
+	tok := node.GetTok()
+	switch node.GetName() {
+	case astSinNodeName:
+		return e.compileSin(tok)
+	case astUnNodeName:
+		if tok.Type == TTIllegal {
+			return nil, illegalNodeErr(tok)
+		}
+		child, err := e.compile(node.(*astUnNode).Node)
+		if err != nil {
+			return nil, err
+		}
+		fun, ok := e.unVisMap[tok.Type]
+		if !ok {
+			return nil, makeErrWithToken(tok, systemErrMsg, fmt.Sprintf("UnKnow Unary type %s", tok.Type))
+		}
+		return func(s *evalScope) (Value, error) {
+			p, err := child(s)
+			if err != nil {
+				return Value{}, err
+			}
+			res, err := fun(p)
+			if err != nil {
+				return Value{}, withTok(err, tok)
+			}
+			return res, nil
+		}, nil
+	case astBinNodeName:
+		return e.compileBin(node.(*astBinNode))
+	case astGeneralNodeName:
+		return e.compileGeneral(node.(*astGeneralNode))
+	}
+	return nil, makeErrWithToken(tok, systemErrMsg, fmt.Sprintf("UnKnow node type %s", node.GetName()))
+}
+
+// compileSin 编译单节点，数字、字符串在编译时解析
+func (e *Engine) compileSin(tok *token) (compiledFn, error) {
+	var val Value
+	switch tok.Type {
+	case TTIdentifier:
+		return func(s *evalScope) (Value, error) {
+			return s.config.lookup(s.identifierMap, tok)
+		}, nil
+	case TTNum:
+		dec, err := decimal.NewFromString(tok.Value)
+		if err != nil {
+			return nil, makeErrWithToken(tok, systemErrMsg, err.Error())
+		}
+		val = NumberValue(dec)
+	case TTString:
+		val = StringValue(tok.Value)
+	default:
+		return nil, illegalNodeErr(tok)
+	}
+	return func(*evalScope) (Value, error) {
+		return val, nil
+	}, nil
+}
+
+// compileBin 编译二叉节点，& | 短路求值
+func (e *Engine) compileBin(node *astBinNode) (compiledFn, error) {
+	tok := node.Tok
+	left, err := e.compile(node.LNode)
+	if err != nil {
+		return nil, err
+	}
+	right, err := e.compile(node.RNode)
+	if err != nil {
+		return nil, err
+	}
+	fun, ok := e.binVisMap[tok.Type]
+	if !ok {
+		return nil, makeErrWithToken(tok, systemErrMsg, fmt.Sprintf("UnKnow Binary type %s", tok.Type))
+	}
+	ctxFun := e.ctxBinVisMap[tok.Type]
+	return func(s *evalScope) (Value, error) {
+		p1, err := left(s)
+		if err != nil {
+			return Value{}, err
+		}
+		res, ok, err := e.shortCircuit(tok.Type, p1)
+		if err != nil {
+			return Value{}, withTok(err, tok)
+		}
+		if ok {
+			return res, nil
+		}
+		p2, err := right(s)
+		if err != nil {
+			return Value{}, err
+		}
+		res, err = s.config.binary(tok, fun, ctxFun, p1, p2)
+		if err != nil {
+			return Value{}, withTok(err, tok)
+		}
+		return res, nil
+	}, nil
+}
+
+// compileGeneral 编译函数节点，函数定义在编译时绑定
+func (e *Engine) compileGeneral(node *astGeneralNode) (compiledFn, error) {
+	tok := node.Tok
+	spec, ok := e.lookupFunc(tok.Value)
+	if !ok {
+		return nil, makeErrWithToken(tok, illegalSyntaxErrMsg, fmt.Sprintf("UnKnow function name %s", tok.Value))
+	}
+	if err := spec.checkArgs(tok.Value, len(node.Nodes)); err != nil {
+		return nil, withTok(err, tok)
+	}
+	args := make([]compiledFn, 0, len(node.Nodes))
+	for _, n := range node.Nodes {
+		arg, err := e.compile(n)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	if spec.Lazy != nil {
+		return func(s *evalScope) (Value, error) {
+			thunks := make([]Thunk, len(args))
+			for idx, arg := range args {
+				arg := arg
+				thunks[idx] = func() (Value, error) {
+					return arg(s)
+				}
+			}
+			res, err := spec.Lazy(thunks...)
+			if err != nil {
+				return Value{}, withTok(err, tok)
+			}
+			return res, nil
+		}, nil
+	}
+	return func(s *evalScope) (Value, error) {
+		ps := make([]Value, len(args))
+		for idx, arg := range args {
+			p, err := arg(s)
+			if err != nil {
+				return Value{}, err
+			}
+			if res, ok := propagateErr(p); ok {
+				return res, nil
+			}
+			ps[idx] = p
+		}
+		res, err := spec.Impl(ps...)
+		if err != nil {
+			return Value{}, withTok(err, tok)
+		}
+		return res, nil
+	}, nil
+}
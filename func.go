@@ -4,40 +4,121 @@
 
 package formula_engine
 
-import "github.com/shopspring/decimal"
-
-// max 返回最大值。
-func max(ps ...*decimal.Decimal) (*decimal.Decimal, error) {
-	m := ps[0]
+// extremum MAX、MIN通用处理，忽略空值，全部为空值时返回空值。better(a, b) 为 a 是否优于 b
+func extremum(better func(c int) bool, ps ...Value) (Value, error) {
+	m := NullValue()
 	for _, p := range ps {
-		if p.GreaterThan(*m) {
+		if p.IsNull() {
+			continue
+		}
+		d, err := toNumber(p)
+		if err != nil {
+			return Value{}, err
+		}
+		if m.IsNull() || better(d.Cmp(m.num)) {
 			m = p
 		}
 	}
 	return m, nil
 }
 
+// max 返回最大值。
+func max(ps ...Value) (Value, error) {
+	return extremum(func(c int) bool { return c > 0 }, ps...)
+}
+
 // min 返回最小值。
-func min(ps ...*decimal.Decimal) (*decimal.Decimal, error) {
-	m := ps[0]
-	for _, p := range ps {
-		if p.LessThan(*m) {
-			m = p
-		}
-	}
-	return m, nil
+func min(ps ...Value) (Value, error) {
+	return extremum(func(c int) bool { return c < 0 }, ps...)
 }
 
-// if_ IF函数,必须为三个参数,IF(term, r1, r2). 若term为真，返回r1，否则返回r2。
+// if_ IF函数,必须为三个参数,IF(term, r1, r2). 若term为真，返回r1，否则返回r2。只计算被选中的分支。
 // em:
 //
 //	IF(2>1, 3, 4) --> return 3
 //	IF(2<1, 3, 4) --> return 4
-func if_(ps ...*decimal.Decimal) (*decimal.Decimal, error) {
-	// 0 表示为假
-	if ps[0].Equal(decimal.Zero) {
-		return ps[2], nil
+//	IF(1, 1, 1/0) --> return 1
+func if_(ps ...Thunk) (Value, error) {
+	term, err := ps[0]()
+	if err != nil {
+		return Value{}, err
+	}
+	if res, ok := propagateErr(term); ok {
+		return res, nil
+	}
+	b, err := toBool(term)
+	if err != nil {
+		return Value{}, err
+	}
+	if !b {
+		return ps[2]()
+	}
+	return ps[1]()
+}
+
+// ifPick 条件为常量时IF所取的分支，条件为错误值或不能转为布尔时不裁剪
+func ifPick(term Value) (int, bool) {
+	if _, ok := propagateErr(term); ok {
+		return 0, false
+	}
+	b, err := toBool(term)
+	if err != nil {
+		return 0, false
+	}
+	if !b {
+		return 2, true
 	}
-	// 否则为真
-	return ps[1], nil
+	return 1, true
+}
+
+// and_ AND函数，所有参数为真时返回真，否则返回假。遇到假值后不再计算后续参数。
+func and_(ps ...Thunk) (Value, error) {
+	for _, p := range ps {
+		v, err := p()
+		if err != nil {
+			return Value{}, err
+		}
+		if res, ok := propagateErr(v); ok {
+			return res, nil
+		}
+		b, err := toBool(v)
+		if err != nil {
+			return Value{}, err
+		}
+		if !b {
+			return BoolValue(false), nil
+		}
+	}
+	return BoolValue(true), nil
+}
+
+// or_ OR函数，任一参数为真时返回真，否则返回假。遇到真值后不再计算后续参数。
+func or_(ps ...Thunk) (Value, error) {
+	for _, p := range ps {
+		v, err := p()
+		if err != nil {
+			return Value{}, err
+		}
+		if res, ok := propagateErr(v); ok {
+			return res, nil
+		}
+		b, err := toBool(v)
+		if err != nil {
+			return Value{}, err
+		}
+		if b {
+			return BoolValue(true), nil
+		}
+	}
+	return BoolValue(false), nil
+}
+
+// true_ TRUE函数，返回真
+func true_(...Value) (Value, error) {
+	return BoolValue(true), nil
+}
+
+// false_ FALSE函数，返回假
+func false_(...Value) (Value, error) {
+	return BoolValue(false), nil
 }
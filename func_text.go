@@ -0,0 +1,265 @@
+// ----------------------------------------------------------------------------------------------------------------
+// func ，文本函数处理。字符串位置、长度均以字符（rune）计，位置从1开始
+// ----------------------------------------------------------------------------------------------------------------
+
+package formula_engine
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"regexp"
+	"strings"
+)
+
+// len_ LEN(text)，返回字符个数
+func len_(ps ...Value) (Value, error) {
+	s, err := toText(ps[0])
+	if err != nil {
+		return Value{}, err
+	}
+	return NumberValue(decimal.NewFromInt(int64(len([]rune(s))))), nil
+}
+
+// upper UPPER(text)，转为大写
+func upper(ps ...Value) (Value, error) {
+	s, err := toText(ps[0])
+	if err != nil {
+		return Value{}, err
+	}
+	return StringValue(strings.ToUpper(s)), nil
+}
+
+// lower LOWER(text)，转为小写
+func lower(ps ...Value) (Value, error) {
+	s, err := toText(ps[0])
+	if err != nil {
+		return Value{}, err
+	}
+	return StringValue(strings.ToLower(s)), nil
+}
+
+// trim TRIM(text)，去掉首尾空白字符
+func trim(ps ...Value) (Value, error) {
+	s, err := toText(ps[0])
+	if err != nil {
+		return Value{}, err
+	}
+	return StringValue(strings.TrimSpace(s)), nil
+}
+
+// textAndCount LEFT、RIGHT的参数：文本及字符个数（默认为1）
+func textAndCount(ps ...Value) ([]rune, int, error) {
+	s, err := toText(ps[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	n := 1
+	if len(ps) > 1 {
+		n, err = toInt(ps[1])
+		if err != nil {
+			return nil, 0, err
+		}
+		if n < 0 {
+			return nil, 0, newEvalErr(illegalCalErrMsg, fmt.Sprintf("Count must not be negative, got %d", n))
+		}
+	}
+	rs := []rune(s)
+	if n > len(rs) {
+		n = len(rs)
+	}
+	return rs, n, nil
+}
+
+// left LEFT(text, [n])，返回前n个字符，n默认为1
+func left(ps ...Value) (Value, error) {
+	rs, n, err := textAndCount(ps...)
+	if err != nil {
+		return Value{}, err
+	}
+	return StringValue(string(rs[:n])), nil
+}
+
+// right RIGHT(text, [n])，返回后n个字符，n默认为1
+func right(ps ...Value) (Value, error) {
+	rs, n, err := textAndCount(ps...)
+	if err != nil {
+		return Value{}, err
+	}
+	return StringValue(string(rs[len(rs)-n:])), nil
+}
+
+// mid MID(text, start, n)，返回从第start个字符开始的n个字符
+func mid(ps ...Value) (Value, error) {
+	s, err := toText(ps[0])
+	if err != nil {
+		return Value{}, err
+	}
+	start, err := toInt(ps[1])
+	if err != nil {
+		return Value{}, err
+	}
+	n, err := toInt(ps[2])
+	if err != nil {
+		return Value{}, err
+	}
+	if start < 1 || n < 0 {
+		return Value{}, newEvalErr(illegalCalErrMsg, fmt.Sprintf("Invalid start %d or count %d", start, n))
+	}
+	rs := []rune(s)
+	if start > len(rs) {
+		return StringValue(""), nil
+	}
+	end := len(rs)
+	if n < len(rs)-(start-1) {
+		end = start - 1 + n
+	}
+	return StringValue(string(rs[start-1 : end])), nil
+}
+
+// concat CONCAT(text1, ...)，拼接所有参数
+func concat(ps ...Value) (Value, error) {
+	var str strings.Builder
+	for _, p := range ps {
+		s, err := toText(p)
+		if err != nil {
+			return Value{}, err
+		}
+		str.WriteString(s)
+	}
+	return StringValue(str.String()), nil
+}
+
+// substitute SUBSTITUTE(text, old, new, [instance])，将old替换为new。指定instance时只替换第instance次出现的old
+func substitute(ps ...Value) (Value, error) {
+	strs := make([]string, 3)
+	for idx := range strs {
+		s, err := toText(ps[idx])
+		if err != nil {
+			return Value{}, err
+		}
+		strs[idx] = s
+	}
+	s, old, new_ := strs[0], strs[1], strs[2]
+	if old == "" {
+		return StringValue(s), nil
+	}
+	if len(ps) < 4 {
+		return StringValue(strings.ReplaceAll(s, old, new_)), nil
+	}
+	instance, err := toInt(ps[3])
+	if err != nil {
+		return Value{}, err
+	}
+	if instance < 1 {
+		return Value{}, newEvalErr(illegalCalErrMsg, fmt.Sprintf("Instance must be greater than 0, got %d", instance))
+	}
+	offset := 0
+	for count := 1; ; count++ {
+		idx := strings.Index(s[offset:], old)
+		if idx < 0 {
+			return StringValue(s), nil
+		}
+		idx += offset
+		if count == instance {
+			return StringValue(s[:idx] + new_ + s[idx+len(old):]), nil
+		}
+		offset = idx + len(old)
+	}
+}
+
+// find FIND(find, within, [start])，返回find在within中从第start个字符开始首次出现的位置，区分大小写。找不到时返回错误值
+func find(ps ...Value) (Value, error) {
+	sub, err := toText(ps[0])
+	if err != nil {
+		return Value{}, err
+	}
+	s, err := toText(ps[1])
+	if err != nil {
+		return Value{}, err
+	}
+	start := 1
+	if len(ps) > 2 {
+		start, err = toInt(ps[2])
+		if err != nil {
+			return Value{}, err
+		}
+	}
+	rs := []rune(s)
+	if start < 1 || start > len(rs)+1 {
+		return Value{}, newEvalErr(illegalCalErrMsg, fmt.Sprintf("Invalid start %d", start))
+	}
+	idx := strings.Index(string(rs[start-1:]), sub)
+	if idx < 0 {
+		return ErrorValue(newEvalErr(illegalCalErrMsg, fmt.Sprintf("Cannot find '%s' in '%s'", sub, s))), nil
+	}
+	pos := start + len([]rune(string(rs[start-1:])[:idx]))
+	return NumberValue(decimal.NewFromInt(int64(pos))), nil
+}
+
+// text TEXT(number, [format])，按格式格式化数字。format 支持：
+//
+//	"0"、"0.00"     保留的小数位数
+//	"#,##0.00"      千分位分隔
+//	"0.0%"          百分比
+//
+// 不传format时返回数字的十进制表示，不支持的format返回错误
+func text(ps ...Value) (Value, error) {
+	if res, ok := propagate(ps[0]); ok {
+		return res, nil
+	}
+	d, err := toNumber(ps[0])
+	if err != nil {
+		return Value{}, err
+	}
+	if len(ps) == 1 {
+		return StringValue(d.String()), nil
+	}
+	format, err := toText(ps[1])
+	if err != nil {
+		return Value{}, err
+	}
+	if !textFormat.MatchString(format) {
+		return Value{}, newEvalErr(illegalCalErrMsg, fmt.Sprintf("Unsupported format '%s', expected such as \"0.00\", \"#,##0.00\" or \"0.0%%\"", format))
+	}
+	percent := strings.HasSuffix(format, "%")
+	if percent {
+		format = strings.TrimSuffix(format, "%")
+		d = d.Mul(decimal.NewFromInt(100))
+	}
+	places := 0
+	if idx := strings.IndexByte(format, '.'); idx >= 0 {
+		places = len(format) - idx - 1
+		format = format[:idx]
+	}
+	str := d.StringFixed(int32(places))
+	if strings.Contains(format, ",") {
+		str = groupThousands(str)
+	}
+	if percent {
+		str += "%"
+	}
+	return StringValue(str), nil
+}
+
+// textFormat TEXT支持的format：整数部分由'0'、'#'、','组成（','不能在首尾），可带由'0'组成的小数部分及'%'
+var textFormat = regexp.MustCompile(`^[#0]([#0,]*[#0])?(\.0+)?%?$`)
+
+// groupThousands 为数字字符串的整数部分添加千分位分隔符
+func groupThousands(str string) string {
+	sign := ""
+	if strings.HasPrefix(str, "-") {
+		sign, str = "-", str[1:]
+	}
+	intPart, fracPart := str, ""
+	if idx := strings.IndexByte(str, '.'); idx >= 0 {
+		intPart, fracPart = str[:idx], str[idx:]
+	}
+	var res strings.Builder
+	for idx := range intPart {
+		if idx > 0 && (len(intPart)-idx)%3 == 0 {
+			res.WriteByte(',')
+		}
+		res.WriteByte(intPart[idx])
+	}
+	return sign + res.String() + fracPart
+}
@@ -1,5 +1,7 @@
 package formula_engine
 
+import "unicode"
+
 // IsDigit 是否是数字
 func IsDigit(c uint8) bool {
 	if c >= '0' && c <= '9' {
@@ -29,8 +31,18 @@ func IsLoAlpha(c uint8) bool {
 	return false
 }
 
+// IsFuncName name是否能被词法分析器识别为函数名：字母开头，由字母和'.'组成，字母包括各语言的文字
+func IsFuncName(name string) bool {
+	for i, c := range name {
+		if !(unicode.IsLetter(c) || (i > 0 && c == '.')) {
+			return false
+		}
+	}
+	return name != ""
+}
+
 // InSlice sub是否在s中
-func InSlice[T uint8 | string | TT](s []T, sub T) bool {
+func InSlice[T uint8 | rune | string | TT](s []T, sub T) bool {
 	for _, em := range s {
 		if em == sub {
 			return true
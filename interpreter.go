@@ -2,7 +2,6 @@ package formula_engine
 
 import (
 	"fmt"
-	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 )
 
@@ -11,142 +10,156 @@ type interpreter struct {
 	Root          AstNode
 	IdentifierMap map[string]string
 	CurrentToken  *token
+	engine        *Engine
+	config        *evalConfig
 	// 该map能够根据节点类型决定访问哪个visit方法
-	visitMap map[string]func(node AstNode) (*decimal.Decimal, error)
+	visitMap map[string]func(node AstNode) (Value, error)
 	// 该map能够通过TT类型决定访问哪个一元计算方法
-	unVisMap map[TT]func(p *decimal.Decimal) (*decimal.Decimal, error)
+	unVisMap map[TT]func(p Value) (Value, error)
 	// 该map能够通过TT类型决定访问哪个二元计算方法
-	binVisMap map[TT]func(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error)
+	binVisMap map[TT]func(p1 Value, p2 Value) (Value, error)
 }
 
-func newInterpreter(root AstNode, identifierMap map[string]string) *interpreter {
+func newInterpreter(root AstNode, identifierMap map[string]string, e *Engine, config *evalConfig) *interpreter {
 	i := &interpreter{
 		Root:          root,
 		IdentifierMap: identifierMap,
+		engine:        e,
+		config:        config,
+		unVisMap:      e.unVisMap,
+		binVisMap:     e.binVisMap,
 	}
-	i.visitMap = map[string]func(node AstNode) (*decimal.Decimal, error){
+	i.visitMap = map[string]func(node AstNode) (Value, error){
 		astSinNodeName:     i.visitAstSinNode,
 		astUnNodeName:      i.visitAstUnNode,
 		astBinNodeName:     i.visitAstBinNode,
 		astGeneralNodeName: i.visitAstGeneralNode,
 	}
-	i.unVisMap = map[TT]func(p *decimal.Decimal) (*decimal.Decimal, error){
-		TTPlus:  unPlus,
-		TTMinus: unMinus,
-		TTNot:   not,
-	}
-	i.binVisMap = map[TT]func(p1 *decimal.Decimal, p2 *decimal.Decimal) (*decimal.Decimal, error){
-		TTPlus:  plus,
-		TTMinus: minus,
-		TTMul:   mul,
-		TTDiv:   div,
-		TTPow:   pow,
-		TTAnd:   and,
-		TTOr:    or,
-		TTEq:    eq,
-		TTNeq:   neq,
-		TTGt:    gt,
-		TTGte:   gte,
-		TTLt:    lt,
-		TTLte:   lte,
-	}
 	return i
 }
 
-func (i *interpreter) Interpret() (*decimal.Decimal, error) {
-	return i.visit(i.Root)
+func (i *interpreter) Interpret() (Value, error) {
+	return i.config.result(i.visit(i.Root))
 }
 
-// visit 通用访问入口
-func (i *interpreter) visit(node AstNode) (*decimal.Decimal, error) {
-	i.CurrentToken = node.GetTok()
-	return i.visitMap[node.GetName()](node)
+// visit 通用访问入口，有计算限制时检查限制
+func (i *interpreter) visit(node AstNode) (Value, error) {
+	tok := node.GetTok()
+	i.CurrentToken = tok
+	if !i.config.limited() {
+		return i.visitMap[node.GetName()](node)
+	}
+	if err := i.config.enter(tok); err != nil {
+		return Value{}, err
+	}
+	res, err := i.visitMap[node.GetName()](node)
+	i.config.leave()
+	if err != nil {
+		return Value{}, err
+	}
+	if err := i.config.checkDigits(res, tok); err != nil {
+		return Value{}, err
+	}
+	return res, nil
 }
 
 // visitAstSinNode 访问单节点
-func (i *interpreter) visitAstSinNode(node AstNode) (*decimal.Decimal, error) {
+func (i *interpreter) visitAstSinNode(node AstNode) (Value, error) {
 	tok := node.GetTok()
 	// 如果该token为变量，通过IdentifierMap获取其值。
 	if tok.Type == TTIdentifier {
-		val, ok := i.IdentifierMap[tok.Value]
-		//if !ok {
-		//	return nil, makeErrWithToken(tok, illegalCalErrMsg, fmt.Sprintf("Cannot found a value by key %s in IdentifierMap, please plus it.", tok.Value))
-		//}
-		if !ok {
-			val = zeroStr
-		}
-		tok.Value = val
+		return i.config.lookup(i.IdentifierMap, tok)
+	}
+	if tok.Type == TTString {
+		return StringValue(tok.Value), nil
+	}
+	if tok.Type == TTIllegal {
+		return Value{}, illegalNodeErr(tok)
 	}
 	dec, err := decimal.NewFromString(tok.Value)
 	if err != nil {
-		return nil, makeErrWithToken(tok, systemErrMsg, err.Error())
+		return Value{}, makeErrWithToken(tok, systemErrMsg, err.Error())
 	}
-	return &dec, nil
+	return NumberValue(dec), nil
 }
 
 // visitAstUnNode 访问单支节点
-func (i *interpreter) visitAstUnNode(node AstNode) (*decimal.Decimal, error) {
+func (i *interpreter) visitAstUnNode(node AstNode) (Value, error) {
 	tok := i.CurrentToken
 	binNode, ok := node.(*astUnNode)
 	if !ok {
-		return nil, makeErrWithToken(node.GetTok(), systemErrMsg, "Is not astUnNode type,please check method GetName().")
+		return Value{}, makeErrWithToken(node.GetTok(), systemErrMsg, "Is not astUnNode type,please check method GetName().")
+	}
+	if tok.Type == TTIllegal {
+		return Value{}, illegalNodeErr(tok)
 	}
 	child, err := i.visit(binNode.Node)
 	if err != nil {
-		return nil, err
+		return Value{}, err
 	}
 	fun, ok := i.unVisMap[tok.Type]
 	if !ok {
-		return nil, makeErrWithToken(tok, systemErrMsg, fmt.Sprintf("UnKnow Unary type %s", i.CurrentToken.Type))
+		return Value{}, makeErrWithToken(tok, systemErrMsg, fmt.Sprintf("UnKnow Unary type %s", i.CurrentToken.Type))
+	}
+	res, err := fun(child)
+	if err != nil {
+		return Value{}, withTok(err, tok)
 	}
-	return fun(child)
+	return res, nil
 }
 
 // visitAstBinNode 访问二叉节点
-func (i *interpreter) visitAstBinNode(node AstNode) (*decimal.Decimal, error) {
+func (i *interpreter) visitAstBinNode(node AstNode) (Value, error) {
 	tok := i.CurrentToken
 	binNode, ok := node.(*astBinNode)
 	if !ok {
-		return nil, makeErrWithToken(node.GetTok(), systemErrMsg, "Is not astBinNode type,please check method GetName().")
+		return Value{}, makeErrWithToken(node.GetTok(), systemErrMsg, "Is not astBinNode type,please check method GetName().")
 	}
 	left, err := i.visit(binNode.LNode)
 	if err != nil {
-		return nil, err
+		return Value{}, err
+	}
+	// & 左侧为假、| 左侧为真时短路，不再计算右侧
+	res, ok, err := i.engine.shortCircuit(tok.Type, left)
+	if err != nil {
+		return Value{}, withTok(err, tok)
+	}
+	if ok {
+		return res, nil
 	}
 	right, err := i.visit(binNode.RNode)
 	if err != nil {
-		return nil, err
+		return Value{}, err
 	}
 	fun, ok := i.binVisMap[tok.Type]
 	if !ok {
-		return nil, makeErrWithToken(i.CurrentToken, systemErrMsg, fmt.Sprintf("UnKnow Binary type %s", i.CurrentToken.Type))
+		return Value{}, makeErrWithToken(tok, systemErrMsg, fmt.Sprintf("UnKnow Binary type %s", tok.Type))
 	}
-	res, err := fun(left, right)
+	res, err = i.config.binary(tok, fun, i.engine.ctxBinVisMap[tok.Type], left, right)
 	if err != nil {
-		return nil, errors.Wrapf(err, getTokPos(tok))
+		return Value{}, withTok(err, tok)
 	}
 	return res, nil
 }
 
 // visitAstGeneralNode 访问一般节点
-func (i *interpreter) visitAstGeneralNode(node AstNode) (*decimal.Decimal, error) {
+func (i *interpreter) visitAstGeneralNode(node AstNode) (Value, error) {
 	tok := i.CurrentToken
 	binNode, ok := node.(*astGeneralNode)
 	if !ok {
-		return nil, makeErrWithToken(node.GetTok(), systemErrMsg, "Is not astGeneralNode type,please check method GetName().")
+		return Value{}, makeErrWithToken(node.GetTok(), systemErrMsg, "Is not astGeneralNode type,please check method GetName().")
 	}
-	params := make([]*decimal.Decimal, 0)
+	params := make([]Thunk, 0, len(binNode.Nodes))
 	for _, n := range binNode.Nodes {
-		param, err := i.visit(n)
-		if err != nil {
-			return nil, err
-		}
-		params = append(params, param)
+		n := n
+		params = append(params, func() (Value, error) {
+			return i.visit(n)
+		})
 	}
 
-	res, err := function(tok.Value, params...)
+	res, err := function(i.engine, tok.Value, params...)
 	if err != nil {
-		return nil, errors.Wrapf(err, getTokPos(tok))
+		return Value{}, withTok(err, tok)
 	}
 	return res, nil
 }
@@ -2,37 +2,66 @@ package formula_engine
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
-// lexer 词法分析器
+// lexer 词法分析器，按字符（rune）分析，位置为字节偏移
 type lexer struct {
 	FStr        string
-	Idx         int
-	CurrentChar uint8 // 当前的字符
+	Idx         int  // 当前字符的字节偏移
+	CurrentChar rune // 当前的字符，全角标点已转换为对应的半角字符
+	RawChar     rune // 当前的原始字符，用于字符串
+	width       int  // 当前字符的字节数
+	runes       []int
+	engine      *Engine
+	Recovering  bool    // 容错模式：遇到错误时记录到Errs并继续分析
+	Errs        []error // 容错模式下记录的错误
 }
 
-func newLexer(fStr string) *lexer {
+func newLexer(fStr string, e *Engine) *lexer {
 	l := &lexer{
 		FStr:        fStr,
 		Idx:         -1,
 		CurrentChar: 0,
+		width:       1,
+		runes:       runeOffsets(fStr),
+		engine:      e,
 	}
 	l.advance()
 	return l
 }
 
+// runeOffsets 字节偏移 => 字符偏移，多字节字符的各个字节对应同一个字符偏移，末尾多一项为字符总数
+func runeOffsets(str string) []int {
+	offsets := make([]int, len(str)+1)
+	n := 0
+	for b := 0; b < len(str); n++ {
+		_, w := utf8.DecodeRuneInString(str[b:])
+		for k := 0; k < w; k++ {
+			offsets[b+k] = n
+		}
+		b += w
+	}
+	offsets[len(str)] = n
+	return offsets
+}
+
 // MakeTokens 获取tokens
 func (l *lexer) MakeTokens() ([]*token, error) {
 	tokens := make([]*token, 0)
 	for l.CurrentChar != 0 {
 		switch {
-		case InSlice([]uint8{' ', '\t'}, l.CurrentChar):
+		case InSlice([]rune{' ', '\t'}, l.CurrentChar):
 			l.advance()
-		case IsDigit(l.CurrentChar):
-			token, err := l.makeNumber()
+		case isDigit(l.CurrentChar) || (l.CurrentChar == '.' && isDigit(l.peek())):
+			token, err := l.makeOrRecover(l.makeNumber, func() {
+				l.skipWhile(func(c rune) bool { return isDigit(c) || InSlice([]rune{'.', '_', 'e', 'E'}, c) })
+			})
 			if err != nil {
-				return nil, err // todo: 错误处理
+				return nil, err
 			}
 			tokens = append(tokens, token)
 		case l.CurrentChar == '+':
@@ -43,6 +72,8 @@ func (l *lexer) MakeTokens() ([]*token, error) {
 			tokens = append(tokens, l.makeCharacter(TTMul))
 		case l.CurrentChar == '/':
 			tokens = append(tokens, l.makeCharacter(TTDiv))
+		case l.CurrentChar == '%':
+			tokens = append(tokens, l.makeCharacter(TTPercent))
 		case l.CurrentChar == '^':
 			tokens = append(tokens, l.makeCharacter(TTPow))
 		case l.CurrentChar == '(':
@@ -63,77 +94,216 @@ func (l *lexer) MakeTokens() ([]*token, error) {
 			tokens = append(tokens, l.makeCompare(TTGt))
 		case l.CurrentChar == '<':
 			tokens = append(tokens, l.makeCompare(TTLt))
+		case l.CurrentChar == '"' || l.CurrentChar == '\'':
+			token, err := l.makeOrRecover(l.makeString, func() {})
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token)
 		case l.CurrentChar == '{':
-			token, err := l.makeIdentifier()
+			token, err := l.makeOrRecover(l.makeIdentifier, func() {
+				l.skipWhile(func(c rune) bool { return isIdentChar(c) || InSlice([]rune{'.', '[', ']'}, c) })
+				if l.CurrentChar == '}' {
+					l.advance()
+				}
+			})
 			if err != nil {
 				return nil, err
 			}
 			tokens = append(tokens, token)
-		case IsAlpha(l.CurrentChar):
-			token, err := l.makeFunction()
+		case unicode.IsLetter(l.CurrentChar):
+			token, err := l.makeOrRecover(l.makeFunction, func() {})
 			if err != nil {
 				return nil, err
 			}
 			tokens = append(tokens, token)
 		default:
-			// 没有匹配到，非法字符错误
-			return nil, l.makeErr(illegalCharErrMsg, fmt.Sprintf("UnExpected character '%c'", l.CurrentChar))
+			// 没有匹配到，非法字符错误。容错模式下跳过该字符
+			err := l.report(l.makeErr(illegalCharErrMsg, fmt.Sprintf("UnExpected character '%c'", l.RawChar)))
+			if err != nil {
+				return nil, err
+			}
+			l.advance()
 		}
 	}
-	tokens = append(tokens, newToken(TTEof, TTEof, l.Idx, l.Idx))
+	tokens = append(tokens, l.newToken(TTEof, TTEof, len(l.FStr), len(l.FStr)))
 	return tokens, nil
 }
 
+// makeOrRecover 调用make生成token。容错模式下出错时记录错误，调用skip跳过剩余的非法字符，并生成非法token
+func (l *lexer) makeOrRecover(make func() (*token, error), skip func()) (*token, error) {
+	start := l.Idx
+	token, err := make()
+	if err == nil {
+		return token, nil
+	}
+	if err = l.report(err); err != nil {
+		return nil, err
+	}
+	skip()
+	if l.Idx == start {
+		l.advance()
+	}
+	end := l.Idx
+	if end > len(l.FStr) {
+		end = len(l.FStr)
+	}
+	return l.newToken(TTIllegal, l.FStr[start:end], start, end-1), nil
+}
+
+// newToken 生成token，根据字节偏移补充字符偏移
+func (l *lexer) newToken(type_ TT, value string, start int, end int) *token {
+	tok := newToken(type_, value, start, end)
+	tok.StartRune, tok.EndRune = l.runeAt(start), l.runeAt(end)
+	return tok
+}
+
+// runeAt 字节偏移对应的字符偏移
+func (l *lexer) runeAt(idx int) int {
+	switch {
+	case idx < 0:
+		return 0
+	case idx > len(l.FStr):
+		return l.runes[len(l.FStr)]
+	}
+	return l.runes[idx]
+}
+
+// skipWhile 跳过满足条件的字符
+func (l *lexer) skipWhile(f func(c rune) bool) {
+	for l.CurrentChar != 0 && f(l.CurrentChar) {
+		l.advance()
+	}
+}
+
+// report 容错模式下记录错误并返回nil，否则直接返回错误
+func (l *lexer) report(err error) error {
+	if !l.Recovering {
+		return err
+	}
+	l.Errs = append(l.Errs, err)
+	return nil
+}
+
 // makeCharacter 处理字符，通用组装token方法
 func (l *lexer) makeCharacter(type_ TT) *token {
-	token := newToken(type_, string(l.CurrentChar), l.Idx, l.Idx)
+	start := l.Idx
+	value := string(l.CurrentChar)
 	l.advance()
-	return token
+	return l.newToken(type_, value, start, l.Idx-1)
 }
 
-// makeNumber 处理数字：整数、小数
+// maxExponent 数字字面量科学计数法的指数的最大绝对值
+const maxExponent = 10000
+
+// makeNumber 处理数字：整数、小数（可省略整数部分，如 .5）、科学计数法（如 1.5e-3），
+// 数字之间可使用'_'分隔（如 1_000_000）。token的值去掉'_'，省略的整数部分补0
 func (l *lexer) makeNumber() (*token, error) {
-	var numBuilder strings.Builder
-	dotCount := 0
+	var num strings.Builder
 	start := l.Idx
-	//for InSlice(append(Digits, '.'), l.CurrentChar) {
-	for IsDigit(l.CurrentChar) || l.CurrentChar == '.' {
+	if l.CurrentChar == '.' {
+		num.WriteByte('0')
+	} else if err := l.readDigits(&num); err != nil {
+		return nil, err
+	}
+
+	if l.CurrentChar == '.' {
+		num.WriteByte('.')
+		l.advance()
+		if !isDigit(l.CurrentChar) {
+			// 如果数字最后一位不是 0~9 ,即有可能是 .
+			return nil, l.makeErrAt(start, l.Idx-1, l.FStr[start:l.Idx], illegalCharErrMsg, "UnExpected character '.', expected '0'~'9'")
+		}
+		if err := l.readDigits(&num); err != nil {
+			return nil, err
+		}
 		if l.CurrentChar == '.' {
-			if dotCount == 1 {
-				return nil, l.makeErr(illegalCharErrMsg, "UnExpected character '.', Only one '.' is allowed")
-			}
-			dotCount += 1
-			numBuilder.WriteByte('.')
-		} else {
-			numBuilder.WriteByte(l.CurrentChar)
+			return nil, l.makeErr(illegalCharErrMsg, "UnExpected character '.', Only one '.' is allowed")
 		}
-		l.advance()
 	}
 
-	str := numBuilder.String()
+	if l.CurrentChar == 'e' || l.CurrentChar == 'E' {
+		num.WriteByte('e')
+		l.advance()
+		if l.CurrentChar == '+' || l.CurrentChar == '-' {
+			num.WriteRune(l.CurrentChar)
+			l.advance()
+		}
+		if !isDigit(l.CurrentChar) {
+			return nil, l.makeErrAt(start, l.Idx-1, l.FStr[start:l.Idx], illegalCharErrMsg, "Incomplete exponent, expected '0'~'9' after 'e'")
+		}
+		digits := num.Len()
+		if err := l.readDigits(&num); err != nil {
+			return nil, err
+		}
+		if l.CurrentChar == '.' {
+			return nil, l.makeErr(illegalCharErrMsg, "UnExpected character '.', the exponent must be an integer")
+		}
+		// 指数过大时，计算结果的位数过多，无法在合理的时间内计算
+		if exp, err := strconv.Atoi(num.String()[digits:]); err != nil || exp > maxExponent {
+			return nil, l.makeErrAt(start, l.Idx-1, l.FStr[start:l.Idx], illegalCharErrMsg,
+				fmt.Sprintf("Number '%s' is out of range, the exponent must be between -%d and %d", l.FStr[start:l.Idx], maxExponent, maxExponent))
+		}
+	}
+	return l.newToken(TTNum, num.String(), start, l.Idx-1), nil
+}
 
-	// 判断是否有错误
-	if !IsDigit(str[len(str)-1]) {
-		// 如果数字最后一位不是 0~9 ,即有可能是 .
-		return nil, l.makeErr(illegalCharErrMsg, fmt.Sprintf("UnExpected character '%c', expected '0'~'9'", str[len(str)-1]))
+// readDigits 读取连续的数字，'_'只能位于两个数字之间，写入时去掉'_'。调用时当前字符必须是数字
+func (l *lexer) readDigits(num *strings.Builder) error {
+	for {
+		num.WriteRune(l.CurrentChar)
+		l.advance()
+		if l.CurrentChar == '_' {
+			l.advance()
+			if !isDigit(l.CurrentChar) {
+				return l.makeErrAt(l.Idx-1, l.Idx-1, "_", illegalCharErrMsg, "UnExpected character '_', '_' is only allowed between digits")
+			}
+		}
+		if !isDigit(l.CurrentChar) {
+			return nil
+		}
 	}
+}
 
-	return newToken(TTNum, numBuilder.String(), start, l.Idx-1), nil
+// makeString 处理字符串，使用双引号或单引号包裹，支持转义：\\ \" \' \n \t \r。字符串中的全角字符保持原样
+func (l *lexer) makeString() (*token, error) {
+	var str strings.Builder
+	quote := l.RawChar
+	start := l.Idx
+	l.advance()
+	for l.RawChar != quote {
+		switch {
+		case l.CurrentChar == 0:
+			return nil, l.makeErrAt(start, l.Idx-1, l.FStr[start:], illegalCharErrMsg, fmt.Sprintf("UnExpected end of input, expected %c to close the string", quote))
+		case l.RawChar == '\\':
+			l.advance()
+			c, ok := escapeChars[l.RawChar]
+			if !ok {
+				return nil, l.makeErr(illegalCharErrMsg, fmt.Sprintf("UnExpected escape character '%c'", l.RawChar))
+			}
+			str.WriteRune(c)
+		default:
+			str.WriteRune(l.RawChar)
+		}
+		l.advance()
+	}
+	l.advance()
+	return l.newToken(TTString, str.String(), start, l.Idx-1), nil
 }
 
 // makeNot 处理非 ! 或者不等于 !=
 func (l *lexer) makeNot() *token {
 	var str strings.Builder
 	begin := l.Idx
-	str.WriteByte(l.CurrentChar)
+	str.WriteRune(l.CurrentChar)
 	l.advance()
 	// 判断是否是 !=
 	if l.CurrentChar == '=' {
-		str.WriteByte(l.CurrentChar)
+		str.WriteRune(l.CurrentChar)
 		l.advance()
-		return newToken(TTNeq, str.String(), begin, l.Idx-1)
+		return l.newToken(TTNeq, str.String(), begin, l.Idx-1)
 	}
-	return newToken(TTNot, str.String(), begin, l.Idx-1)
+	return l.newToken(TTNot, str.String(), begin, l.Idx-1)
 }
 
 // makeCompare 处理大于号或者小于号 > >= < <=
@@ -141,11 +311,11 @@ func (l *lexer) makeCompare(type_ TT) *token {
 	var str strings.Builder
 
 	begin := l.Idx
-	str.WriteByte(l.CurrentChar)
+	str.WriteRune(l.CurrentChar)
 	l.advance()
 	// 判断是否是 >= 或者 <=
 	if l.CurrentChar == '=' {
-		str.WriteByte(l.CurrentChar)
+		str.WriteRune(l.CurrentChar)
 		if type_ == TTGt {
 			type_ = TTGte
 		} else {
@@ -153,61 +323,147 @@ func (l *lexer) makeCompare(type_ TT) *token {
 		}
 		l.advance()
 	}
-	return newToken(type_, str.String(), begin, l.Idx-1)
+	return l.newToken(type_, str.String(), begin, l.Idx-1)
 }
 
-// makeIdentifier 处理变量
+// makeIdentifier 处理变量，字母包括各语言的文字，如 {数量}。
+// 变量名可由'.'分隔为多段，每段可带下标，如 {order.total}、{items[2].qty}；使用引号包裹时可包含任意字符，如 {"Unit Price (USD)"}。
+// 引号是变量名中唯一的转义方式：'}'直接写在引号中，如 {"a}b"}；引号中的转义与字符串相同，不支持 \}
 func (l *lexer) makeIdentifier() (*token, error) {
 	var (
 		str strings.Builder
 	)
 	l.advance()
 	start := l.Idx
-	// 变量开头不是'字母'或者'_',报错
-	if !(IsAlpha(l.CurrentChar) || l.CurrentChar == '_') {
-		return nil, l.makeErr(illegalCharErrMsg, fmt.Sprintf("UnExpected Initial '%c', expected letter or '_'", l.CurrentChar))
-	}
-	// 字符是字母、数字或'_'
-	for IsAlpha(l.CurrentChar) || IsDigit(l.CurrentChar) || l.CurrentChar == '_' {
-		str.WriteByte(l.CurrentChar)
-		l.advance()
+	if l.RawChar == '"' || l.RawChar == '\'' {
+		quoted, err := l.makeString()
+		if err != nil {
+			return nil, err
+		}
+		if quoted.Value == "" {
+			return nil, l.makeErrAt(start, l.Idx-1, l.FStr[start:l.Idx], illegalCharErrMsg, "Identifier must not be empty")
+		}
+		str.WriteString(quoted.Value)
+	} else {
+		for {
+			// 变量（每一段）开头不是'字母'或者'_',报错
+			if !(unicode.IsLetter(l.CurrentChar) || l.CurrentChar == '_') {
+				return nil, l.makeErr(illegalCharErrMsg, fmt.Sprintf("UnExpected Initial '%c', expected letter or '_'", l.RawChar))
+			}
+			// 字符是字母、数字或'_'
+			for isIdentChar(l.CurrentChar) {
+				str.WriteRune(l.CurrentChar)
+				l.advance()
+			}
+			// 下标，如 items[2]
+			for l.CurrentChar == '[' {
+				str.WriteRune(l.CurrentChar)
+				l.advance()
+				if !isDigit(l.CurrentChar) {
+					return nil, l.makeErr(illegalCharErrMsg, fmt.Sprintf("UnExpected character '%c', expected '0'~'9' in an index", l.RawChar))
+				}
+				for isDigit(l.CurrentChar) {
+					str.WriteRune(l.CurrentChar)
+					l.advance()
+				}
+				if l.CurrentChar != ']' {
+					return nil, l.makeErr(illegalCharErrMsg, fmt.Sprintf("UnExpected character '%c', expected ']' after an index", l.RawChar))
+				}
+				str.WriteRune(l.CurrentChar)
+				l.advance()
+			}
+			if l.CurrentChar != '.' {
+				break
+			}
+			str.WriteRune(l.CurrentChar)
+			l.advance()
+		}
 	}
 
 	if l.CurrentChar != '}' {
-		return nil, l.makeErr(illegalCharErrMsg, fmt.Sprintf("UnExpected character '%c', expected '}' after an Identifier", l.CurrentChar))
+		return nil, l.makeErr(illegalCharErrMsg, fmt.Sprintf("UnExpected character '%c', expected '}' after an Identifier", l.RawChar))
 	}
+	end := l.Idx - 1
 	l.advance()
-	return newToken(TTIdentifier, str.String(), start, l.Idx-2), nil
+	return l.newToken(TTIdentifier, str.String(), start, end), nil
 }
 
-// makeFunction 处理函数
+// makeFunction 处理函数，字母包括各语言的文字
 func (l *lexer) makeFunction() (*token, error) {
 	var strBuilder strings.Builder
 	start := l.Idx
-	for IsAlpha(l.CurrentChar) || l.CurrentChar == '.' {
-		strBuilder.WriteByte(l.CurrentChar)
+	for unicode.IsLetter(l.CurrentChar) || l.CurrentChar == '.' {
+		strBuilder.WriteRune(l.CurrentChar)
 		l.advance()
 	}
 
 	str := strings.ToUpper(strBuilder.String())
-	_, ok := FuncMap[str]
-	if !ok {
-		return nil, l.makeErr(illegalCharErrMsg, fmt.Sprintf("UnKnow function name %s", str))
+	_, ok := l.engine.lookupFunc(str)
+	// 容错模式下由语法分析器报告未知函数
+	if !ok && !l.Recovering {
+		return nil, l.makeErrAt(start, l.Idx-1, strBuilder.String(), illegalCharErrMsg, fmt.Sprintf("UnKnow function name %s", str))
 	}
-	return newToken(TTFunction, str, start, l.Idx-1), nil
+	return l.newToken(TTFunction, str, start, l.Idx-1), nil
 }
 
-// advance 预读
+// advance 预读，全角标点转换为对应的半角字符
 func (l *lexer) advance() {
-	l.Idx += 1
+	l.Idx += l.width
 	if l.Idx < len(l.FStr) {
-		l.CurrentChar = l.FStr[l.Idx]
+		l.RawChar, l.width = utf8.DecodeRuneInString(l.FStr[l.Idx:])
+		l.CurrentChar = normalizeChar(l.RawChar)
 	} else {
-		l.CurrentChar = 0
+		l.RawChar, l.CurrentChar, l.width = 0, 0, 1
+	}
+}
+
+// peek 下一个字符，不移动位置
+func (l *lexer) peek() rune {
+	if next := l.Idx + l.width; next < len(l.FStr) {
+		r, _ := utf8.DecodeRuneInString(l.FStr[next:])
+		return normalizeChar(r)
 	}
+	return 0
 }
 
-// makeErrWithIdx 组装错误
+// normalizeChar 全角标点转换为对应的半角字符，如 （ => (
+func normalizeChar(c rune) rune {
+	if half, ok := fullWidthChars[c]; ok {
+		return half
+	}
+	return c
+}
+
+// isDigit 是否是数字 0~9
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isIdentChar 是否可用于变量名：字母、数字或'_'
+func isIdentChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_'
+}
+
+// makeErr 组装词法错误，定位到当前字符
 func (l *lexer) makeErr(errName, details string) error {
-	return makeStrErr(l.Idx, l.FStr, errName, details)
+	token := ""
+	if l.CurrentChar != 0 {
+		token = string(l.RawChar)
+	}
+	end := l.Idx + l.width - 1
+	if end >= len(l.FStr) {
+		end = l.Idx
+	}
+	return l.makeErrAt(l.Idx, end, token, errName, details)
+}
+
+// makeErrAt 组装词法错误，定位到[start, end]
+func (l *lexer) makeErrAt(start, end int, token, errName, details string) error {
+	return &LexError{ErrorInfo: ErrorInfo{
+		Kind:    errName,
+		Msg:     details,
+		Span:    Span{Start: start, End: end, StartRune: l.runeAt(start), EndRune: l.runeAt(end)},
+		Located: true,
+		Token:   token,
+	}}
 }
@@ -0,0 +1,166 @@
+package formula_engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"math"
+)
+
+// ctxCheckInterval 每计算多少步检查一次 context 是否已取消
+const ctxCheckInterval = 64
+
+// WithMaxSteps 限制计算的步数（约为计算的节点数），防止计算时间过长。n<=0时不限制
+func WithMaxSteps(n int) EvalOption {
+	return func(c *evalConfig) {
+		c.maxSteps = n
+	}
+}
+
+// WithMaxDepth 限制计算的嵌套深度，防止嵌套过深。n<=0时不限制
+func WithMaxDepth(n int) EvalOption {
+	return func(c *evalConfig) {
+		c.maxDepth = n
+	}
+}
+
+// WithMaxDigits 限制中间结果的十进制位数（整数位与小数位之和），防止如 9^9^9^9 的计算耗尽时间和内存。
+// 乘方在计算前预估结果的位数，超出时不再计算。n<=0时不限制
+func WithMaxDigits(n int) EvalOption {
+	return func(c *evalConfig) {
+		c.maxDigits = n
+	}
+}
+
+// limited 是否需要检查限制
+func (c *evalConfig) limited() bool {
+	return c.ctx != nil || c.maxSteps > 0 || c.maxDepth > 0 || c.maxDigits > 0
+}
+
+// enter 开始计算一个节点：计步、检查深度及 context
+func (c *evalConfig) enter(tok *token) error {
+	if err := c.step(tok); err != nil {
+		return err
+	}
+	c.depth++
+	return c.checkDepth(c.depth, tok)
+}
+
+// step 计步并检查 context。超出限制后，之后的计算均返回同一错误
+func (c *evalConfig) step(tok *token) error {
+	if c.exceeded != nil {
+		return c.exceeded
+	}
+	c.steps++
+	if c.maxSteps > 0 && c.steps > c.maxSteps {
+		return c.exceed(tok, LimitSteps, c.maxSteps, nil, fmt.Sprintf("Evaluation exceeded the limit of %d steps", c.maxSteps))
+	}
+	if c.ctx != nil && c.steps%ctxCheckInterval == 1 {
+		if err := c.ctx.Err(); err != nil {
+			return c.exceed(tok, LimitContext, 0, err, fmt.Sprintf("Evaluation stopped: %s", err))
+		}
+	}
+	return nil
+}
+
+// checkDepth 检查嵌套深度
+func (c *evalConfig) checkDepth(depth int, tok *token) error {
+	if c.maxDepth > 0 && depth > c.maxDepth {
+		return c.exceed(tok, LimitDepth, c.maxDepth, nil, fmt.Sprintf("Evaluation exceeded the maximum depth of %d", c.maxDepth))
+	}
+	return nil
+}
+
+// leave 结束计算一个节点
+func (c *evalConfig) leave() {
+	c.depth--
+}
+
+// checkDigits 检查结果的位数
+func (c *evalConfig) checkDigits(v Value, tok *token) error {
+	if c.maxDigits <= 0 {
+		return nil
+	}
+	d, ok := v.Number()
+	if !ok {
+		return nil
+	}
+	if n := numDigits(d); n > c.maxDigits {
+		return c.exceed(tok, LimitDigits, c.maxDigits, nil, fmt.Sprintf("Result has %d digits, exceeding the limit of %d digits", n, c.maxDigits))
+	}
+	return nil
+}
+
+// checkBinary 二元运算前检查，乘方预估结果的位数
+func (c *evalConfig) checkBinary(tok *token, p1 Value, p2 Value) error {
+	if c.maxDigits <= 0 || tok.Type != TTPow {
+		return nil
+	}
+	base, ok1 := p1.Number()
+	exp, ok2 := p2.Number()
+	if !ok1 || !ok2 {
+		return nil
+	}
+	if n := powDigits(base, exp); n > float64(c.maxDigits) {
+		return c.exceed(tok, LimitDigits, c.maxDigits, nil, fmt.Sprintf("Result would have about %.0f digits, exceeding the limit of %d digits", n, c.maxDigits))
+	}
+	return nil
+}
+
+// binary 二元运算：检查限制后计算。计算可取消且运算可中断（ctxFun 不为nil）时使用 ctxFun，如乘方在相乘之间检查 ctx
+func (c *evalConfig) binary(tok *token, fun func(p1 Value, p2 Value) (Value, error), ctxFun func(ctx context.Context, p1 Value, p2 Value) (Value, error), p1 Value, p2 Value) (Value, error) {
+	if err := c.checkBinary(tok, p1, p2); err != nil {
+		return Value{}, err
+	}
+	if ctxFun == nil || c.ctx == nil || c.ctx.Done() == nil {
+		return fun(p1, p2)
+	}
+	if err := c.ctx.Err(); err != nil {
+		return Value{}, c.exceed(tok, LimitContext, 0, err, fmt.Sprintf("Evaluation stopped: %s", err))
+	}
+	res, err := ctxFun(c.ctx, p1, p2)
+	if ctxErr := c.ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+		return Value{}, c.exceed(tok, LimitContext, 0, ctxErr, fmt.Sprintf("Evaluation stopped: %s", ctxErr))
+	}
+	return res, err
+}
+
+// result 计算结束时，若超出限制的错误被惰性函数忽略，仍返回该错误
+func (c *evalConfig) result(res Value, err error) (Value, error) {
+	if c.exceeded != nil {
+		return Value{}, c.exceeded
+	}
+	return res, err
+}
+
+// exceed 记录并返回超出限制的错误
+func (c *evalConfig) exceed(tok *token, kind LimitKind, max int, cause error, details string) error {
+	c.exceeded = withTok(&LimitError{ErrorInfo: ErrorInfo{Kind: limitErrMsg, Msg: details}, Limit: kind, Max: max, cause: cause}, tok)
+	return c.exceeded
+}
+
+// numDigits 数字写成十进制时的位数：整数位与小数位之和
+func numDigits(d decimal.Decimal) int {
+	n, exp := d.NumDigits(), int(d.Exponent())
+	if exp >= 0 {
+		return n + exp
+	}
+	if -exp > n {
+		return -exp
+	}
+	return n
+}
+
+// powDigits 预估乘方结果的位数。乘方只使用指数的整数部分，指数为负时先计算正指数的结果
+func powDigits(base decimal.Decimal, exp decimal.Decimal) float64 {
+	n := exp.Truncate(0).Abs().InexactFloat64()
+	if n == 0 || base.IsZero() {
+		return 0
+	}
+	digits := math.Max(math.Log10(base.Abs().InexactFloat64()), 0)
+	if e := base.Exponent(); e < 0 {
+		digits += float64(-e)
+	}
+	return n * digits
+}
@@ -0,0 +1,302 @@
+package formula_engine
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// OptimizeReport 优化结果统计
+type OptimizeReport struct {
+	Folded     int // 折叠为常量的子树个数
+	Simplified int // 化简的恒等式个数，如 x*1、x+0、--x、!!x
+	Pruned     int // 条件为常量时裁剪的分支个数，如 IF(1>0, {a}, {b})、0 & {x}
+}
+
+// Changed 是否有变化
+func (r OptimizeReport) Changed() bool {
+	return r.Folded+r.Simplified+r.Pruned > 0
+}
+
+// 折叠常量时的计算限制，超出时保留原样，防止如 9^9^9 的公式使优化无法结束
+const (
+	foldMaxDigits = 1000
+	foldMaxSteps  = 10000
+)
+
+// optimizer ast优化器
+type optimizer struct {
+	engine *Engine
+	report OptimizeReport
+}
+
+// Optimize 使用默认Engine优化ast树
+func Optimize(node AstNode) (AstNode, OptimizeReport) {
+	return defaultEngine.Optimize(node)
+}
+
+// Optimize 优化ast树，返回优化后的新树，不修改原树。
+//   - 折叠常量子树，使用Engine的运算符、函数计算；计算出错、超出计算限制（如结果超过1000位）、结果为空值或错误值时保留原样
+//   - 化简恒等式 x*1、1*x、x+0、0+x、--x，以及x为布尔时的 !!x
+//   - 条件为常量时裁剪 IF 的分支、& | 的右侧
+//
+// 化简恒等式时假设变量及函数的结果为数字：结果为字符串时，原公式会报类型错误，化简后不再报错。
+// Engine替换过运算符时不化简恒等式；FuncSpec.Volatile 为 true 的函数不会被折叠
+func (e *Engine) Optimize(node AstNode) (AstNode, OptimizeReport) {
+	o := &optimizer{engine: e}
+	res := o.optimize(DeepCopyAstNode(node))
+	return res, o.report
+}
+
+// optimize 自底向上优化节点，返回代替该节点的节点
+func (o *optimizer) optimize(node AstNode) AstNode {
+	switch node.GetName() {
+	case astUnNodeName:
+		n := node.(*astUnNode)
+		n.Node = o.optimize(n.Node)
+		return o.unary(n)
+	case astBinNodeName:
+		n := node.(*astBinNode)
+		n.LNode = o.optimize(n.LNode)
+		n.RNode = o.optimize(n.RNode)
+		return o.binary(n)
+	case astGeneralNodeName:
+		n := node.(*astGeneralNode)
+		for idx, c := range n.Nodes {
+			n.Nodes[idx] = o.optimize(c)
+		}
+		return o.general(n)
+	}
+	return node
+}
+
+// unary 优化一元节点
+func (o *optimizer) unary(n *astUnNode) AstNode {
+	if _, ok := o.value(n); ok {
+		return n
+	}
+	if _, ok := o.value(n.Node); ok {
+		return o.fold(n)
+	}
+	child, ok := n.Node.(*astUnNode)
+	if !ok || child.Tok.Type != n.Tok.Type || o.engine.customOps {
+		return n
+	}
+	switch {
+	case n.Tok.Type == TTMinus && !o.nonNumber(child.Node):
+		o.report.Simplified++
+		return child.Node
+	case n.Tok.Type == TTNot && o.isBool(child.Node):
+		o.report.Simplified++
+		return child.Node
+	}
+	return n
+}
+
+// binary 优化二叉节点
+func (o *optimizer) binary(n *astBinNode) AstNode {
+	lv, lok := o.value(n.LNode)
+	_, rok := o.value(n.RNode)
+	if lok && rok {
+		return o.fold(n)
+	}
+	if lok {
+		if res, short, err := o.engine.shortCircuit(n.Tok.Type, lv); err == nil && short {
+			if lit, ok := o.literal(res, n.Tok); ok {
+				o.report.Pruned++
+				return lit
+			}
+		}
+	}
+	if o.engine.customOps {
+		return n
+	}
+	var unit int64
+	switch n.Tok.Type {
+	case TTMul:
+		unit = 1
+	case TTPlus:
+		unit = 0
+	default:
+		return n
+	}
+	if o.isNumber(n.RNode, unit) && !o.nonNumber(n.LNode) {
+		o.report.Simplified++
+		return n.LNode
+	}
+	if o.isNumber(n.LNode, unit) && !o.nonNumber(n.RNode) {
+		o.report.Simplified++
+		return n.RNode
+	}
+	return n
+}
+
+// general 优化函数节点
+func (o *optimizer) general(n *astGeneralNode) AstNode {
+	spec, ok := o.engine.lookupFunc(n.Tok.Value)
+	if !ok || spec.Volatile || spec.checkArgs(n.Tok.Value, len(n.Nodes)) != nil {
+		return n
+	}
+	if _, ok := o.value(n); ok {
+		return n
+	}
+	if spec.pick != nil && len(n.Nodes) > 0 {
+		if cond, ok := o.value(n.Nodes[0]); ok {
+			if idx, ok := spec.pick(cond); ok {
+				o.report.Pruned++
+				return n.Nodes[idx]
+			}
+		}
+	}
+
+	constant := true
+	for _, c := range n.Nodes {
+		if _, ok := o.value(c); !ok {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		return o.fold(n)
+	}
+	if spec.Lazy == nil {
+		return n
+	}
+
+	// 部分参数为常量的惰性函数：只计算常量参数即可得出结果时折叠，如 AND(0, {x})
+	called := false
+	thunks := make([]Thunk, len(n.Nodes))
+	for idx, c := range n.Nodes {
+		if v, ok := o.value(c); ok {
+			thunks[idx] = func() (Value, error) { return v, nil }
+		} else {
+			thunks[idx] = func() (Value, error) {
+				called = true
+				return Value{}, newEvalErr(systemErrMsg, "Not a constant")
+			}
+		}
+	}
+	res, err := spec.Lazy(thunks...)
+	if err != nil || called {
+		return n
+	}
+	if lit, ok := o.literal(res, n.Tok); ok {
+		o.report.Pruned++
+		return lit
+	}
+	return n
+}
+
+// fold 计算常量子树并替换为字面量，出错或结果不能表示为字面量时保留原样
+func (o *optimizer) fold(node AstNode) AstNode {
+	config := newEvalConfig(WithMaxDigits(foldMaxDigits), WithMaxSteps(foldMaxSteps))
+	res, err := newInterpreter(node, nil, o.engine, config).Interpret()
+	if err != nil {
+		return node
+	}
+	lit, ok := o.literal(res, node.GetTok())
+	if !ok {
+		return node
+	}
+	o.report.Folded++
+	return lit
+}
+
+// literal 将值转为字面量节点，位置使用tok的位置：
+// 非负数为数字节点，负数为一元减号节点，字符串为字符串节点，布尔为 TRUE()/FALSE()。
+// 空值、错误值，以及生成的节点计算结果与原值不同时（如运算符、TRUE函数被替换），返回false
+func (o *optimizer) literal(v Value, tok *token) (AstNode, bool) {
+	var node AstNode
+	switch v.Kind() {
+	case KindNumber:
+		d, _ := v.Number()
+		node = newAstSinNode(newTokenAt(TTNum, d.Abs().String(), tok.span()))
+		if d.Sign() < 0 {
+			node = newAstUnNode(newTokenAt(TTMinus, "-", tok.span()), node)
+		}
+	case KindString:
+		s, _ := v.Str()
+		node = newAstSinNode(newTokenAt(TTString, s, tok.span()))
+	case KindBool:
+		name := "FALSE"
+		if b, _ := v.Bool(); b {
+			name = "TRUE"
+		}
+		node = newAstGeneralNode(newTokenAt(TTFunction, name, tok.span()))
+	default:
+		return nil, false
+	}
+	got, ok := o.value(node)
+	if !ok || got.Kind() != v.Kind() || got.String() != v.String() {
+		return nil, false
+	}
+	return node, true
+}
+
+// value 字面量节点的值，非字面量返回false。字面量为数字、字符串、负数及无参数的非 Volatile 函数
+func (o *optimizer) value(node AstNode) (Value, bool) {
+	tok := node.GetTok()
+	switch node.GetName() {
+	case astSinNodeName:
+		switch tok.Type {
+		case TTNum:
+			dec, err := decimal.NewFromString(tok.Value)
+			if err != nil {
+				return Value{}, false
+			}
+			return NumberValue(dec), true
+		case TTString:
+			return StringValue(tok.Value), true
+		}
+	case astUnNodeName:
+		child := node.(*astUnNode).Node
+		fun, ok := o.engine.unVisMap[tok.Type]
+		if tok.Type != TTMinus || !ok || child.GetName() != astSinNodeName || child.GetTok().Type != TTNum {
+			return Value{}, false
+		}
+		v, _ := o.value(child)
+		res, err := fun(v)
+		return res, err == nil
+	case astGeneralNodeName:
+		if len(node.(*astGeneralNode).Nodes) > 0 {
+			return Value{}, false
+		}
+		spec, ok := o.engine.lookupFunc(tok.Value)
+		if !ok || spec.Volatile || spec.Impl == nil || spec.checkArgs(tok.Value, 0) != nil {
+			return Value{}, false
+		}
+		res, err := spec.Impl()
+		return res, err == nil && res.Kind() != KindError
+	}
+	return Value{}, false
+}
+
+// isNumber 节点是否为等于n的数字字面量
+func (o *optimizer) isNumber(node AstNode, n int64) bool {
+	v, ok := o.value(node)
+	d, isNum := v.Number()
+	return ok && isNum && d.Equal(decimal.NewFromInt(n))
+}
+
+// nonNumber 节点的值是否一定不是数字：字符串字面量、布尔，以及比较运算的结果
+func (o *optimizer) nonNumber(node AstNode) bool {
+	if v, ok := o.value(node); ok && v.Kind() == KindString {
+		return true
+	}
+	if node.GetName() == astBinNodeName && InSlice([]TT{TTEq, TTNeq, TTGt, TTGte, TTLt, TTLte}, node.GetTok().Type) {
+		return true
+	}
+	return o.isBool(node)
+}
+
+// isBool 节点的值是否一定为布尔（或向上传递的错误值）：! & | 的结果及布尔字面量
+func (o *optimizer) isBool(node AstNode) bool {
+	if v, ok := o.value(node); ok {
+		return v.Kind() == KindBool
+	}
+	switch node.GetTok().Type {
+	case TTNot:
+		return node.GetName() == astUnNodeName
+	case TTAnd, TTOr:
+		return node.GetName() == astBinNodeName
+	}
+	return false
+}
@@ -1,9 +1,6 @@
 package formula_engine
 
-import (
-	"fmt"
-	"github.com/pkg/errors"
-)
+import "fmt"
 
 // parser 语法解析器
 type parser struct {
@@ -11,13 +8,17 @@ type parser struct {
 	CurrentToken *token
 	LastIdx      int
 	Idx          int
+	engine       *Engine
+	Recovering   bool    // 容错模式：遇到错误时记录到Errs并继续解析，出错的部分使用非法节点代替
+	Errs         []error // 容错模式下记录的错误
 }
 
-func newParser(t []*token) *parser {
+func newParser(t []*token, e *Engine) *parser {
 	p := &parser{
 		Tokens:  t,
 		LastIdx: -1,
 		Idx:     -1,
+		engine:  e,
 	}
 	p.advance()
 	return p
@@ -32,13 +33,25 @@ func newParser(t []*token) *parser {
 // <pri_ope> ::= <pri_ope> { +|- <sec_ope> }                                   // Primary operation
 // <sec_ope> ::= <sec_ope> { *|/ <ter_ope> }                                   // Secondary operation
 // <ter_ope> ::= <factor> { ^ <ter_ope> }                                      // Tertiary operation
-// <factor> ::= NUM| FUNCTION LPAREN [ expr { COMMA expr }] RPAREN| IDENTIFIER| { PLUS | MINUS } <factor>| LPAREN <expr> RPAREN
+// <factor> ::= { PLUS | MINUS } <factor>| <primary> { PERCENT }
+// <primary> ::= NUM| STRING| FUNCTION LPAREN [ expr { COMMA expr }] RPAREN| IDENTIFIER| LPAREN <expr> RPAREN
 func (p *parser) Parse() (AstNode, error) {
 	res, err := p.expr()
 	if err != nil {
 		return nil, err
-	} else if p.CurrentToken.Type != TTEof {
-		return nil, p.makeErr(illegalSyntaxErrMsg, fmt.Sprintf("Unable to parse completely.Idx: %d", p.Idx))
+	}
+	for p.CurrentToken.Type != TTEof {
+		err := p.report(p.makeErr(illegalSyntaxErrMsg, fmt.Sprintf("Unable to parse completely.Idx: %d", p.Idx)))
+		if err != nil {
+			return nil, err
+		}
+		// 容错模式下跳过多余的token，继续解析剩余部分以发现更多错误
+		p.advance()
+		if p.CurrentToken.Type != TTEof {
+			if _, err := p.expr(); err != nil {
+				return nil, err
+			}
+		}
 	}
 	return res, nil
 }
@@ -82,15 +95,10 @@ func (p *parser) terOpe() (AstNode, error) {
 	return p.binOpLeft(p.factor, p.terOpe, []TT{TTPow})
 }
 
-// factor <factor> ::= NUM | FUNCTION LPAREN [ expr { COMMA IDENTIFIER }] RPAREN | IDENTIFIER | { PLUS | MINUS } factor | LPAREN expr RPAREN
+// factor <factor> ::= { PLUS | MINUS } factor | <primary> { PERCENT }
 func (p *parser) factor() (AstNode, error) {
 	tok := p.CurrentToken
-	switch {
-	case InSlice([]TT{TTNum, TTIdentifier}, tok.Type):
-		// NUM | IDENTIFIER
-		p.advance()
-		return newAstSinNode(tok), nil
-	case InSlice([]TT{TTPlus, TTMinus}, tok.Type):
+	if InSlice([]TT{TTPlus, TTMinus}, tok.Type) {
 		// { PLUS | MINUS } factor
 		p.advance()
 		fac, err := p.factor()
@@ -98,11 +106,32 @@ func (p *parser) factor() (AstNode, error) {
 			return nil, err
 		}
 		return newAstUnNode(tok, fac), nil
+	}
+	node, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	// 后缀百分号，如 5% 即 0.05
+	for p.CurrentToken.Type == TTPercent {
+		node = newAstUnNode(p.CurrentToken, node)
+		p.advance()
+	}
+	return node, nil
+}
+
+// primary <primary> ::= NUM | STRING | FUNCTION LPAREN [ expr { COMMA expr }] RPAREN | IDENTIFIER | LPAREN expr RPAREN
+func (p *parser) primary() (AstNode, error) {
+	tok := p.CurrentToken
+	switch {
+	case InSlice([]TT{TTNum, TTString, TTIdentifier, TTIllegal}, tok.Type):
+		// NUM | STRING | IDENTIFIER，非法token只在容错模式下出现，错误已由词法分析器记录
+		p.advance()
+		return newAstSinNode(tok), nil
 	case tok.Type == TTFunction:
 		// FUNCTION LPAREN [ expr { COMMA IDENTIFIER }] RPAREN
 		p.advance()
 		if p.CurrentToken.Type != TTLparen {
-			return nil, p.makeErr(illegalSyntaxErrMsg, fmt.Sprintf("UnExpected tokType:'%s', expected '(' after function name", p.CurrentToken.Type))
+			return p.fail(p.makeErr(illegalSyntaxErrMsg, fmt.Sprintf("UnExpected tokType:'%s', expected '(' after function name", p.CurrentToken.Type)), tok)
 		}
 		params := make([]AstNode, 0)
 		p.advance()
@@ -123,18 +152,24 @@ func (p *parser) factor() (AstNode, error) {
 		}
 
 		if p.CurrentToken.Type != TTRparen {
-			return nil, p.makeErr(illegalSyntaxErrMsg, fmt.Sprintf("UnExpected tokType:'%s', expected ')' when there is '(' before", p.CurrentToken.Type))
+			err := p.report(p.makeErr(illegalSyntaxErrMsg, fmt.Sprintf("UnExpected tokType:'%s', expected ')' when there is '(' before", p.CurrentToken.Type)))
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			p.advance()
 		}
-		num, ok := FuncParNumMap[tok.Value]
+		spec, ok := p.engine.lookupFunc(tok.Value)
 		if !ok {
-			return nil, p.makeErr(systemErrMsg, fmt.Sprintf("Can not found function name %s in FuncParNumMap, please plus it", tok.Value))
+			err := &SyntaxError{ErrorInfo: ErrorInfo{Kind: illegalSyntaxErrMsg, Msg: fmt.Sprintf("UnKnow function name %s", tok.Value)}}
+			return p.fail(withTok(err, tok), tok)
 		}
-		err := checkParNum(num, len(params))
+		err := spec.checkArgs(tok.Value, len(params))
 		if err != nil {
-			return nil, errors.Wrapf(err, getTokPos(tok))
+			if err = p.report(withTok(err, tok)); err != nil {
+				return nil, err
+			}
 		}
-
-		p.advance()
 		return newAstGeneralNode(tok, params...), nil
 
 	case tok.Type == TTLparen:
@@ -148,10 +183,19 @@ func (p *parser) factor() (AstNode, error) {
 			p.advance()
 			return expr, nil
 		} else {
-			return nil, p.makeErr(illegalSyntaxErrMsg, fmt.Sprintf("UnExpected tokType:'%s', expected ')' when there is '(' before", tok.Type))
+			err := p.report(p.makeErr(illegalSyntaxErrMsg, fmt.Sprintf("UnExpected tokType:'%s', expected ')' when there is '(' before", p.CurrentToken.Type)))
+			if err != nil {
+				return nil, err
+			}
+			return expr, nil
 		}
 	default:
-		return nil, p.makeErr(illegalSyntaxErrMsg, fmt.Sprintf("UnExpected tokType:'%s'", tok.Type))
+		err := p.makeErr(illegalSyntaxErrMsg, fmt.Sprintf("UnExpected tokType:'%s'", tok.Type))
+		// 容错模式下跳过无法作为操作数的token，右括号、逗号、结束符留给上层处理
+		if p.Recovering && !InSlice([]TT{TTRparen, TTComma, TTEof}, tok.Type) {
+			p.advance()
+		}
+		return p.fail(err, tok)
 	}
 }
 
@@ -217,7 +261,33 @@ func (p *parser) rollBackToLast() {
 	p.CurrentToken = p.Tokens[p.Idx]
 }
 
-// makeErrWithIdx 组装错误
+// report 容错模式下记录错误并返回nil，否则直接返回错误。同一位置只记录第一个错误
+func (p *parser) report(err error) error {
+	if !p.Recovering {
+		return err
+	}
+	if n := len(p.Errs); n > 0 && errSpan(p.Errs[n-1]) == errSpan(err) {
+		return nil
+	}
+	p.Errs = append(p.Errs, err)
+	return nil
+}
+
+// fail 容错模式下记录错误，返回位于tok的非法节点代替出错的部分，否则直接返回错误
+func (p *parser) fail(err error, tok *token) (AstNode, error) {
+	if err = p.report(err); err != nil {
+		return nil, err
+	}
+	text := tok.Value
+	if tok.Type == TTEof {
+		text = ""
+	}
+	return newAstSinNode(newTokenAt(TTIllegal, text, tok.span())), nil
+}
+
+// makeErr 组装语法错误，定位到当前token
 func (p *parser) makeErr(errName, details string) error {
-	return makeErrWithIdx(p.Idx, errName, details)
+	err := &SyntaxError{ErrorInfo: ErrorInfo{Kind: errName, Msg: details}}
+	err.locate(p.CurrentToken)
+	return err
 }
@@ -0,0 +1,207 @@
+package formula_engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// pathSegment 路径中的一段：键或下标
+type pathSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// String 路径段的原文，用于报错
+func (s pathSegment) String() string {
+	if s.isIndex {
+		return fmt.Sprintf("[%d]", s.index)
+	}
+	return s.key
+}
+
+// parsePath 解析路径，如 order.items[2].qty 解析为 order、items、[2]、qty
+func parsePath(path string) ([]pathSegment, error) {
+	segs := make([]pathSegment, 0)
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		if idx := strings.IndexByte(part, '['); idx >= 0 {
+			key = part[:idx]
+		}
+		if key == "" {
+			return nil, &PathError{Path: path, Segment: part, Msg: "empty key"}
+		}
+		segs = append(segs, pathSegment{key: key})
+		for rest := part[len(key):]; rest != ""; {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, &PathError{Path: path, Segment: part, Msg: "expected '[index]' after a key"}
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, &PathError{Path: path, Segment: rest[:end+1], Msg: "index must be a non-negative integer"}
+			}
+			segs = append(segs, pathSegment{index: index, isIndex: true})
+			rest = rest[end+1:]
+		}
+	}
+	return segs, nil
+}
+
+// ResolvePath 按路径获取嵌套数据中的值，如 order.customer.tier、items[2].qty。
+// data 可以是 map（键为字符串）、切片、数组、结构体及其指针，可任意嵌套；结构体字段按 `formula` 标签、`json` 标签、字段名（不区分大小写）匹配。
+// data 为 map 或结构体且存在与 path 完全相同的键时直接使用该键，如 map[string]any{"order.total": 1}。
+// 段不存在（键不存在、下标越界、上一段为nil）时返回 NotFound 为 true 的 *PathError
+func ResolvePath(data any, path string) (Value, error) {
+	root := indirect(reflect.ValueOf(data))
+	if v, ok, err := child(root, pathSegment{key: path}); err == nil && ok {
+		return toValue(v, path, path)
+	}
+	segs, err := parsePath(path)
+	if err != nil {
+		return Value{}, err
+	}
+	cur, last := root, ""
+	for idx, seg := range segs {
+		if !cur.IsValid() {
+			msg := "data is null"
+			if idx > 0 {
+				msg = fmt.Sprintf("'%s' is null", segs[idx-1])
+			}
+			return Value{}, &PathError{Path: path, Segment: seg.String(), NotFound: true, Msg: msg}
+		}
+		next, ok, err := child(cur, seg)
+		if err != nil {
+			return Value{}, &PathError{Path: path, Segment: seg.String(), Msg: err.Error()}
+		}
+		if !ok {
+			return Value{}, &PathError{Path: path, Segment: seg.String(), NotFound: true, Msg: "not found"}
+		}
+		cur, last = indirect(next), seg.String()
+	}
+	return toValue(cur, path, last)
+}
+
+// indirect 解除指针、接口的引用，nil返回无效值
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		// Value、decimal.Decimal 等作为值使用，不再解除引用
+		if v.Kind() == reflect.Pointer && isScalarType(v.Type()) {
+			return v
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// child 获取v中的键或下标，不存在时ok为false，v的类型不支持该段时报错
+func child(v reflect.Value, seg pathSegment) (res reflect.Value, ok bool, err error) {
+	switch v.Kind() {
+	case reflect.Map:
+		if seg.isIndex || v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		res = v.MapIndex(reflect.ValueOf(seg.key).Convert(v.Type().Key()))
+		return res, res.IsValid(), nil
+	case reflect.Struct:
+		if seg.isIndex || isScalarType(v.Type()) {
+			break
+		}
+		res = structField(v, seg.key)
+		return res, res.IsValid(), nil
+	case reflect.Slice, reflect.Array:
+		if !seg.isIndex {
+			break
+		}
+		if seg.index >= v.Len() {
+			return reflect.Value{}, false, nil
+		}
+		return v.Index(seg.index), true, nil
+	}
+	if !v.IsValid() {
+		return reflect.Value{}, false, nil
+	}
+	return reflect.Value{}, false, fmt.Errorf("cannot get '%s' from %s", seg, v.Type())
+}
+
+// structField 按 formula 标签、json 标签、字段名（不区分大小写）获取结构体字段
+func structField(v reflect.Value, name string) reflect.Value {
+	t := v.Type()
+	var fallback reflect.Value
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		for _, tag := range []string{"formula", "json"} {
+			tagName := strings.Split(field.Tag.Get(tag), ",")[0]
+			if tagName == name {
+				return v.Field(i)
+			}
+		}
+		if field.Name == name {
+			return v.Field(i)
+		}
+		if !fallback.IsValid() && strings.EqualFold(field.Name, name) {
+			fallback = v.Field(i)
+		}
+	}
+	return fallback
+}
+
+// isScalarType 作为单个值使用的类型
+func isScalarType(t reflect.Type) bool {
+	switch t {
+	case reflect.TypeOf(Value{}), reflect.TypeOf(decimal.Decimal{}), reflect.TypeOf(&decimal.Decimal{}):
+		return true
+	}
+	return false
+}
+
+// toValue 将数据转为 Value：nil为空值，数字类型为数字，字符串为字符串，布尔为布尔。seg 为值所在的段，用于报错
+func toValue(v reflect.Value, path string, seg string) (Value, error) {
+	v = indirect(v)
+	if !v.IsValid() {
+		return NullValue(), nil
+	}
+	switch x := v.Interface().(type) {
+	case Value:
+		return x, nil
+	case decimal.Decimal:
+		return NumberValue(x), nil
+	case *decimal.Decimal:
+		return NumberValue(*x), nil
+	case json.Number:
+		d, err := decimal.NewFromString(x.String())
+		if err != nil {
+			return Value{}, &PathError{Path: path, Segment: seg, Msg: fmt.Sprintf("invalid number '%s'", x)}
+		}
+		return NumberValue(d), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return BoolValue(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NumberValue(decimal.NewFromInt(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return NumberValue(decimal.NewFromBigInt(new(big.Int).SetUint64(v.Uint()), 0)), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return Value{}, &PathError{Path: path, Segment: seg, Msg: fmt.Sprintf("%v is not a finite number", f)}
+		}
+		return NumberValue(decimal.NewFromFloat(f)), nil
+	case reflect.String:
+		return StringValue(v.String()), nil
+	}
+	return Value{}, &PathError{Path: path, Segment: seg, Msg: fmt.Sprintf("value of type %s is not a number, string or bool", v.Type())}
+}
@@ -0,0 +1,134 @@
+package formula_engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FuncSpec 函数定义，包含参数个数、说明及实现
+type FuncSpec struct {
+	MinArgs     int    // 最少参数个数
+	MaxArgs     int    // 最多参数个数，Variadic 为 true 时忽略
+	Variadic    bool   // 是否可变参数，为 true 时参数个数 >= MinArgs 即可
+	Description string // 函数说明
+	// Impl 函数实现，调用前已完成参数个数校验，所有参数均已计算
+	Impl func(...Value) (Value, error)
+	// Lazy 惰性函数实现，参数以 Thunk 传入，只有调用 Thunk 时才计算该参数，用于 IF、AND 等短路求值。
+	// Impl 与 Lazy 只能设置一个
+	Lazy func(...Thunk) (Value, error)
+	// Volatile 结果不只取决于参数（如随机数、当前时间），优化时不会被折叠
+	Volatile bool
+
+	// pick 第一个参数为常量时，返回结果所取的参数下标，用于优化时裁剪 IF 的分支
+	pick func(cond Value) (int, bool)
+}
+
+// Thunk 惰性参数，调用时才计算参数的值
+type Thunk func() (Value, error)
+
+// FuncInfo 函数信息，用于 ListFunctions
+type FuncInfo struct {
+	Name string
+	Spec FuncSpec
+}
+
+// validate 注册前校验函数定义
+func (s FuncSpec) validate() error {
+	if (s.Impl == nil) == (s.Lazy == nil) {
+		return makeErr(illegalFuncErrMsg, "Exactly one of Impl and Lazy is required")
+	}
+	if s.MinArgs < 0 {
+		return makeErr(illegalFuncErrMsg, fmt.Sprintf("MinArgs must not be negative, got %d", s.MinArgs))
+	}
+	if !s.Variadic && s.MaxArgs < s.MinArgs {
+		return makeErr(illegalFuncErrMsg, fmt.Sprintf("MaxArgs %d is less than MinArgs %d", s.MaxArgs, s.MinArgs))
+	}
+	return nil
+}
+
+// checkArgs 函数计算前进行参数个数校验
+func (s FuncSpec) checkArgs(funcName string, length int) error {
+	var details string
+	switch {
+	case s.Variadic && length < s.MinArgs:
+		details = fmt.Sprintf("Required at least %d params,but got %d.", s.MinArgs, length)
+	case s.Variadic:
+		return nil
+	case s.MinArgs == s.MaxArgs && length != s.MinArgs:
+		details = fmt.Sprintf("Required %d params,but got %d.", s.MinArgs, length)
+	case length < s.MinArgs || length > s.MaxArgs:
+		details = fmt.Sprintf("Required %d~%d params,but got %d.", s.MinArgs, s.MaxArgs, length)
+	default:
+		return nil
+	}
+	return &ArityError{
+		ErrorInfo: ErrorInfo{Kind: illegalSyntaxErrMsg, Msg: details, Func: funcName},
+		MinArgs:   s.MinArgs,
+		MaxArgs:   s.MaxArgs,
+		Variadic:  s.Variadic,
+		Got:       length,
+	}
+}
+
+// RegisterFunction 注册函数，同名函数会被覆盖。函数名不区分大小写，必须能被词法分析器识别（字母开头，由字母和'.'组成）。
+// 可与解析、计算并发调用
+func (e *Engine) RegisterFunction(name string, spec FuncSpec) error {
+	if !IsFuncName(name) {
+		return makeErr(illegalFuncErrMsg, fmt.Sprintf("Invalid function name '%s', expected letters or '.' and begin with a letter", name))
+	}
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.funcs[strings.ToUpper(name)] = spec
+	return nil
+}
+
+// UnregisterFunction 注销函数，返回函数是否存在
+func (e *Engine) UnregisterFunction(name string) bool {
+	name = strings.ToUpper(name)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.funcs[name]
+	delete(e.funcs, name)
+	return ok
+}
+
+// ListFunctions 返回已注册的函数，按函数名排序
+func (e *Engine) ListFunctions() []FuncInfo {
+	e.mu.RLock()
+	infos := make([]FuncInfo, 0, len(e.funcs))
+	for name, spec := range e.funcs {
+		infos = append(infos, FuncInfo{Name: name, Spec: spec})
+	}
+	e.mu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// lookupFunc 获取函数定义，name 需为大写
+func (e *Engine) lookupFunc(name string) (FuncSpec, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	spec, ok := e.funcs[name]
+	return spec, ok
+}
+
+// RegisterFunction 在默认Engine中注册函数
+func RegisterFunction(name string, spec FuncSpec) error {
+	return defaultEngine.RegisterFunction(name, spec)
+}
+
+// UnregisterFunction 在默认Engine中注销函数
+func UnregisterFunction(name string) bool {
+	return defaultEngine.UnregisterFunction(name)
+}
+
+// ListFunctions 返回默认Engine中已注册的函数
+func ListFunctions() []FuncInfo {
+	return defaultEngine.ListFunctions()
+}
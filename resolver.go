@@ -0,0 +1,78 @@
+package formula_engine
+
+import (
+	"context"
+	"errors"
+	"github.com/shopspring/decimal"
+)
+
+// ErrNotFound 变量不存在。Resolver 返回该错误（或包装该错误）时按 MissingPolicy 处理
+var ErrNotFound = errors.New("variable not found")
+
+// Resolver 变量解析器，计算时遇到变量才调用，可从缓存、数据库等按需获取变量的值。
+// 变量不存在时返回 ErrNotFound，其他错误作为计算错误返回
+type Resolver interface {
+	Resolve(ctx context.Context, name string) (Value, error)
+}
+
+// ResolverFunc 函数形式的 Resolver
+type ResolverFunc func(ctx context.Context, name string) (Value, error)
+
+// Resolve 调用函数
+func (f ResolverFunc) Resolve(ctx context.Context, name string) (Value, error) {
+	return f(ctx, name)
+}
+
+// StringMapResolver 字符串变量表，变量值的解析规则与 identifierMap 相同
+type StringMapResolver map[string]string
+
+// Resolve 获取变量的值
+func (m StringMapResolver) Resolve(_ context.Context, name string) (Value, error) {
+	val, ok := m[name]
+	if !ok {
+		return Value{}, ErrNotFound
+	}
+	return parseVarValue(val), nil
+}
+
+// DecimalMapResolver 数字变量表
+type DecimalMapResolver map[string]decimal.Decimal
+
+// Resolve 获取变量的值
+func (m DecimalMapResolver) Resolve(_ context.Context, name string) (Value, error) {
+	val, ok := m[name]
+	if !ok {
+		return Value{}, ErrNotFound
+	}
+	return NumberValue(val), nil
+}
+
+// AnyMapResolver 任意类型的变量表，可嵌套，变量名按路径获取，规则见 ResolvePath
+type AnyMapResolver map[string]any
+
+// Resolve 获取变量的值
+func (m AnyMapResolver) Resolve(_ context.Context, name string) (Value, error) {
+	return ResolvePath(map[string]any(m), name)
+}
+
+// dataResolver 按路径从嵌套数据中获取变量的值
+type dataResolver struct {
+	data any
+}
+
+// Resolve 获取变量的值
+func (r dataResolver) Resolve(_ context.Context, name string) (Value, error) {
+	return ResolvePath(r.data, name)
+}
+
+// NewDataResolver 从结构体、map、切片等嵌套数据中按路径获取变量的值，结构体字段按标签匹配，规则见 ResolvePath
+func NewDataResolver(data any) Resolver {
+	return dataResolver{data: data}
+}
+
+// WithResolver 使用 Resolver 获取变量的值，设置后不再使用 identifierMap
+func WithResolver(r Resolver) EvalOption {
+	return func(c *evalConfig) {
+		c.resolver = r
+	}
+}
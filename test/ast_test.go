@@ -0,0 +1,351 @@
+package test
+
+import (
+	formulaengine "e.coding.net/oiine/backend/formula-engine"
+	"errors"
+	"github.com/shopspring/decimal"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVariablesAndFunctions(t *testing.T) {
+	node, err := formulaengine.GetAstTreeByString("IF({a} > 1, max({b}, {a}), -{c}) + MIN({b}, 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars := formulaengine.Variables(node); !reflect.DeepEqual(vars, []string{"a", "b", "c"}) {
+		t.Errorf("unexpected variables %v", vars)
+	}
+	if funcs := formulaengine.Functions(node); !reflect.DeepEqual(funcs, []string{"IF", "MAX", "MIN"}) {
+		t.Errorf("unexpected functions %v", funcs)
+	}
+
+	count := 0
+	formulaengine.Inspect(node, func(n formulaengine.AstNode) bool {
+		count++
+		// 不进入 IF 的参数
+		return n.GetName() != "astGeneralNode" || len(formulaengine.Children(n)) != 3
+	})
+	if count != 5 {
+		t.Errorf("expected 5 visited nodes, got %d", count)
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	cases := []struct {
+		str      string
+		vars     []string
+		expected formulaengine.OptimizeReport
+	}{
+		{"2*3+{x}*1+0", []string{"x"}, formulaengine.OptimizeReport{Folded: 1, Simplified: 2}},
+		{"IF(1>0, {a}, {b})", []string{"a"}, formulaengine.OptimizeReport{Folded: 1, Pruned: 1}},
+		{"--{x} > 1 & !!({a} & {b})", []string{"x", "a", "b"}, formulaengine.OptimizeReport{Simplified: 2}},
+		{"AND(0, {x}) | {y}", []string{"y"}, formulaengine.OptimizeReport{Pruned: 1}},
+		// 除0保留原样，计算时报错
+		{"1/0 + {x}", []string{"x"}, formulaengine.OptimizeReport{}},
+		// 比较的结果可能为空值、布尔乘1报错，均不化简
+		{"(!!({x} > 1)) * 1", []string{"x"}, formulaengine.OptimizeReport{}},
+	}
+	vars := map[string]string{"x": "3", "y": "1", "a": "1", "b": "0"}
+	for _, c := range cases {
+		node, err := formulaengine.GetAstTreeByString(c.str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opt, report := formulaengine.Optimize(node)
+		if report != c.expected {
+			t.Errorf("%s: expected report %+v, got %+v", c.str, c.expected, report)
+		}
+		if got := formulaengine.Variables(opt); !reflect.DeepEqual(got, c.vars) {
+			t.Errorf("%s: expected variables %v, got %v", c.str, c.vars, got)
+		}
+		want, wantErr := formulaengine.CalValueByAstTree(node, vars)
+		got, gotErr := formulaengine.CalValueByAstTree(opt, vars)
+		if want.String() != got.String() || (wantErr == nil) != (gotErr == nil) {
+			t.Errorf("%s: expected %v, %v, got %v, %v", c.str, want, wantErr, got, gotErr)
+		}
+	}
+
+	// 结果过大的常量不折叠，优化很快结束
+	node, err := formulaengine.GetAstTreeByString("9^9^9 + {x}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	opt, report := formulaengine.Optimize(node)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("optimize took %s", elapsed)
+	}
+	if report.Folded != 1 || formulaengine.Format(opt) != "9 ^ 387420489 + {x}" {
+		t.Errorf("expected only 9^9 folded, got %s, %+v", formulaengine.Format(opt), report)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	cases := map[string]string{
+		"1+2*3":                            "1 + 2 * 3",
+		"(1+2)*3":                          "(1 + 2) * 3",
+		"1-(2-3)":                          "1 - (2 - 3)",
+		"(1-2)-3":                          "1 - 2 - 3",
+		"2^(3^2)":                          "2 ^ 3 ^ 2",
+		"(2^3)^2":                          "(2 ^ 3) ^ 2",
+		"-{x}^2":                           "-{x} ^ 2",
+		"-({x}^2)":                         "-({x} ^ 2)",
+		"--{x}":                            "--{x}",
+		"!({a}>1&{b})|{c}":                 "!({a} > 1 & {b}) | {c}",
+		"({a}|{b})&{c}":                    "({a} | {b}) & {c}",
+		"(!{a})+1":                         "(!{a}) + 1",
+		"({a}=1)=({b}=2)":                  "({a} = 1) = ({b} = 2)",
+		"max( {a},if({b}>=2,'x\"',\"\") )": `MAX({a}, IF({b} >= 2, "x\"", ""))`,
+		`"a\\b\n"`:                         `"a\\b\n"`,
+	}
+	for str, expected := range cases {
+		node, err := formulaengine.GetAstTreeByString(str)
+		if err != nil {
+			t.Fatalf("%s: %v", str, err)
+		}
+		got := formulaengine.Format(node)
+		if got != expected {
+			t.Errorf("%s: expected %s, got %s", str, expected, got)
+			continue
+		}
+		reparsed, err := formulaengine.GetAstTreeByString(got)
+		if err != nil {
+			t.Fatalf("%s: %v", got, err)
+		}
+		if !formulaengine.Equal(reparsed, node) {
+			t.Errorf("%s: reparsed tree differs from %s", got, str)
+		}
+	}
+}
+
+func TestEncodeAST(t *testing.T) {
+	str := `IF({a} > 1, MAX({b}, -2.5), "x\"y") & !{c}`
+	node, err := formulaengine.GetAstTreeByString(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := formulaengine.EncodeAST(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := formulaengine.DecodeAST(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formulaengine.Format(decoded) != formulaengine.Format(node) {
+		t.Errorf("expected %s, got %s", formulaengine.Format(node), formulaengine.Format(decoded))
+	}
+	if tok := decoded.GetTok(); tok.Start != 36 || tok.End != 36 {
+		t.Errorf("expected position of '&' to be kept, got %d~%d", tok.Start, tok.End)
+	}
+
+	// 解码时按Engine校验函数
+	e := formulaengine.NewEngine(formulaengine.WithoutBuiltinFuncs())
+	_, err = e.DecodeAST(data)
+	var syntaxErr *formulaengine.SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Token != "IF" {
+		t.Errorf("expected unknown function error, got %v", err)
+	}
+	invalid := []string{
+		`{"version":2,"root":{"kind":"single","type":"NUM","value":"1"}}`,
+		`{"version":1,"root":{"kind":"binary","type":"MOD","value":"%","children":[{"kind":"single","type":"NUM","value":"1"},{"kind":"single","type":"NUM","value":"2"}]}}`,
+		`{"version":1,"root":{"kind":"unary","type":"MINUS","value":"-"}}`,
+		`{"version":1,"root":{"kind":"single","type":"NUM","value":"1.2.3"}}`,
+	}
+	for _, data := range invalid {
+		if _, err := formulaengine.DecodeAST([]byte(data)); err == nil {
+			t.Errorf("%s: expected error", data)
+		}
+	}
+
+	// 带正负号的数字解码为一元负号节点，格式化的结果能被解析为相同的ast树
+	num := func(v string) string { return `{"kind":"single","type":"NUM","value":"` + v + `"}` }
+	data = []byte(`{"version":1,"root":{"kind":"binary","type":"POW","value":"^","children":[` + num("-2") + `,` +
+		`{"kind":"binary","type":"MINUS","value":"-","children":[` + num("-.5") + `,` + num("+1E2") + `]}]}}`)
+	decoded, err = formulaengine.DecodeAST(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formulaengine.Format(decoded); got != "-2 ^ (-0.5 - 1e2)" {
+		t.Errorf("unexpected format %s", got)
+	}
+	reparsed, err := formulaengine.GetAstTreeByString(formulaengine.Format(decoded))
+	if err != nil || !formulaengine.Equal(reparsed, decoded) {
+		t.Errorf("expected the formatted text to parse to the same tree, got %v", err)
+	}
+	for _, v := range []string{"--1", "1.", "1%", "1 2", ""} {
+		if _, err := formulaengine.DecodeAST([]byte(`{"version":1,"root":` + num(v) + `}`)); err == nil {
+			t.Errorf("%q: expected invalid number error", v)
+		}
+	}
+}
+
+func TestToExpr(t *testing.T) {
+	node, err := formulaengine.GetAstTreeByString(`MAX({a} * 2, -1) >= "x"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmp, ok := formulaengine.ToExpr(node).(*formulaengine.BinaryExpr)
+	if !ok || cmp.Op() != formulaengine.TTGte || cmp.Span() != (formulaengine.Span{Start: 17, End: 18, StartRune: 17, EndRune: 18}) {
+		t.Fatalf("expected '>=' at 17~18, got %#v", formulaengine.ToExpr(node))
+	}
+	if s, ok := cmp.Right().(*formulaengine.StringLit); !ok || s.Value() != "x" {
+		t.Errorf("expected string x, got %#v", cmp.Right())
+	}
+	call, ok := cmp.Left().(*formulaengine.CallExpr)
+	if !ok || call.Name() != "MAX" || call.NumArgs() != 2 {
+		t.Fatalf("expected MAX with 2 args, got %#v", cmp.Left())
+	}
+	mul := call.Arg(0).(*formulaengine.BinaryExpr)
+	if v, ok := mul.Left().(*formulaengine.VarRef); !ok || v.Name() != "a" {
+		t.Errorf("expected variable a, got %#v", mul.Left())
+	}
+	neg := call.Arg(1).(*formulaengine.UnaryExpr)
+	if n, ok := neg.Operand().(*formulaengine.NumberLit); !ok || n.Text() != "1" || neg.Op() != formulaengine.TTMinus {
+		t.Errorf("expected -1, got %#v", neg.Operand())
+	}
+	if formulaengine.Format(call.Node()) != "MAX({a} * 2, -1)" {
+		t.Errorf("unexpected node %s", formulaengine.Format(call.Node()))
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	max, err := formulaengine.Call("max", formulaengine.Var("a"), formulaengine.Num(decimal.NewFromInt(-2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := formulaengine.And(
+		formulaengine.Gt(formulaengine.Mul(formulaengine.Add(max, formulaengine.Num(decimal.NewFromInt(1))), formulaengine.Var("b")), formulaengine.Num(decimal.RequireFromString("2.5"))),
+		formulaengine.Not(formulaengine.Eq(formulaengine.Var("c"), formulaengine.Str("x"))),
+	)
+	expected := `(MAX({a}, -2) + 1) * {b} > 2.5 & !{c} = "x"`
+	if got := formulaengine.Format(node); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+	res, err := formulaengine.CalValueByAstTree(node, map[string]string{"a": "1", "b": "2", "c": "y"})
+	if err != nil || res.String() != "TRUE" {
+		t.Errorf("expected TRUE, got %v, %v", res, err)
+	}
+
+	var arityErr *formulaengine.ArityError
+	if _, err := formulaengine.Call("IF", formulaengine.Var("a")); !errors.As(err, &arityErr) {
+		t.Errorf("expected arity error, got %v", err)
+	}
+	if _, err := formulaengine.Call("NOPE"); err == nil {
+		t.Error("expected unknown function error")
+	}
+
+	// 非法的操作数、变量名在构造时 panic
+	one := formulaengine.Num(decimal.NewFromInt(1))
+	invalid := map[string]func(){
+		"Add(nil, 1)":  func() { formulaengine.Add(nil, one) },
+		"Lt(1, nil)":   func() { formulaengine.Lt(one, nil) },
+		"Neg(nil)":     func() { formulaengine.Neg(nil) },
+		"Not(nil)":     func() { formulaengine.Not(nil) },
+		`Var("")`:      func() { formulaengine.Var("") },
+		`Var("a\x00")`: func() { formulaengine.Var("a\x00") },
+	}
+	for name, build := range invalid {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected panic", name)
+				}
+			}()
+			build()
+		}()
+	}
+	// 需要引号的变量名可以构造，格式化后能重新解析
+	quoted := formulaengine.Add(formulaengine.Var("Unit Price (USD)"), formulaengine.Var("a}b"))
+	if _, err := formulaengine.GetAstTreeByString(formulaengine.Format(quoted)); err != nil {
+		t.Errorf("%s: %v", formulaengine.Format(quoted), err)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	node, err := formulaengine.GetAstTreeByString("{net} * {rate} + MAX({net}, 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gross, err := formulaengine.GetAstTreeByString("{gross} - {tax}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inlined, err := formulaengine.SubstituteVariable(node, "net", gross)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formulaengine.Format(inlined); got != "({gross} - {tax}) * {rate} + MAX({gross} - {tax}, 0)" {
+		t.Errorf("unexpected substitution %s", got)
+	}
+	renamed, err := formulaengine.RenameVariable(inlined, "rate", "tax_rate")
+	if err != nil || formulaengine.Format(renamed) != "({gross} - {tax}) * {tax_rate} + MAX({gross} - {tax}, 0)" {
+		t.Errorf("unexpected rename %v, %v", renamed, err)
+	}
+	if _, err := formulaengine.SubstituteVariable(node, "net", nil); err == nil {
+		t.Error("expected an error for a nil replacement")
+	}
+	for _, name := range []string{"", "a\x00b", "\xff"} {
+		if _, err := formulaengine.RenameVariable(node, "rate", name); err == nil {
+			t.Errorf("%q: expected invalid variable name error", name)
+		}
+	}
+	// 原树不变
+	if got := formulaengine.Format(node); got != "{net} * {rate} + MAX({net}, 0)" {
+		t.Errorf("original tree changed: %s", got)
+	}
+
+	// 后序遍历：先替换子节点
+	doubled := formulaengine.Rewrite(node, func(n formulaengine.AstNode) formulaengine.AstNode {
+		if v, ok := formulaengine.ToExpr(n).(*formulaengine.VarRef); ok {
+			return formulaengine.Mul(formulaengine.Var(v.Name()), formulaengine.Num(decimal.NewFromInt(2)))
+		}
+		return nil
+	})
+	if got := formulaengine.Format(doubled); got != "{net} * 2 * ({rate} * 2) + MAX({net} * 2, 0)" {
+		t.Errorf("unexpected rewrite %s", got)
+	}
+}
+
+func TestEqualAndHash(t *testing.T) {
+	parse := func(str string) formulaengine.AstNode {
+		node, err := formulaengine.GetAstTreeByString(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+	cases := []struct {
+		a, b        string
+		equal       bool
+		commutative bool
+	}{
+		{"{a} + 1.50", "({a})+1.5", true, true},
+		{"max({a}, 2)", "MAX({a},2)", true, true},
+		{"{a} + {b} + {c}", "{c} + ({b} + {a})", false, true},
+		{"{a} = {b} & {c}", "{c} & {b} = {a}", false, true},
+		{"{a} - {b}", "{b} - {a}", false, false},
+		{"({a} = {b}) = {c}", "{a} = ({b} = {c})", false, false},
+		{"{a} + {b} * {c}", "{a} * {b} + {c}", false, false},
+	}
+	for _, c := range cases {
+		a, b := parse(c.a), parse(c.b)
+		if got := formulaengine.Equal(a, b); got != c.equal {
+			t.Errorf("Equal(%s, %s): expected %v", c.a, c.b, c.equal)
+		}
+		if got := formulaengine.EqualCommutative(a, b); got != c.commutative {
+			t.Errorf("EqualCommutative(%s, %s): expected %v", c.a, c.b, c.commutative)
+		}
+		if c.equal && formulaengine.Hash(a) != formulaengine.Hash(b) {
+			t.Errorf("Hash(%s) != Hash(%s)", c.a, c.b)
+		}
+		if c.commutative && formulaengine.HashCommutative(a) != formulaengine.HashCommutative(b) {
+			t.Errorf("HashCommutative(%s) != HashCommutative(%s)", c.a, c.b)
+		}
+	}
+	if formulaengine.Hash(parse("{a} + 1")) == formulaengine.Hash(parse("{a} + 2")) {
+		t.Error("expected different hashes")
+	}
+}
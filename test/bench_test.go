@@ -0,0 +1,100 @@
+package test
+
+import (
+	formulaengine "e.coding.net/oiine/backend/formula-engine"
+	"testing"
+)
+
+const benchFormula = "IF({score} > 60 & {level} != 0, MAX({score} * 1.5, {base}) + {bonus} / 2, MIN({base}, 10)) - 3 ^ 2"
+
+var benchVars = map[string]string{"score": "87.5", "level": "3", "base": "100", "bonus": "12"}
+
+func TestProgramMatchesInterpreter(t *testing.T) {
+	formulas := []string{
+		benchFormula,
+		"{x}=0 | 1/{x}>0",
+		"{x}=1 & 1/{x}>0",
+		`IF({x}=0, "zero", CONCAT("x=", {x}))`,
+		"AND(1, OR({x}, 2>1), !FALSE())",
+		"-(-{score})+MAX()",
+	}
+	for _, str := range formulas {
+		node, err := formulaengine.GetAstTreeByString(str)
+		if err != nil {
+			if _, perr := formulaengine.CompileProgram(str); perr == nil {
+				t.Errorf("%s: expected compile error", str)
+			}
+			continue
+		}
+		prog, err := formulaengine.CompileProgram(str)
+		if err != nil {
+			t.Fatalf("%s: %v", str, err)
+		}
+		vm := prog.NewVM()
+		for _, vars := range []map[string]string{benchVars, {"x": "0"}, {"x": "2"}} {
+			want, wantErr := formulaengine.CalValueByAstTree(node, vars)
+			got, gotErr := vm.Run(vars)
+			if (wantErr == nil) != (gotErr == nil) || got.String() != want.String() {
+				t.Errorf("%s %v: expected %v %v, got %v %v", str, vars, want, wantErr, got, gotErr)
+			}
+			if got, gotErr = prog.Eval(vars); got.String() != want.String() || (gotErr == nil) != (wantErr == nil) {
+				t.Errorf("%s %v: Eval expected %v, got %v", str, vars, want, got)
+			}
+		}
+	}
+}
+
+func BenchmarkCalByAstTree(b *testing.B) {
+	node, err := formulaengine.GetAstTreeByString(benchFormula)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := formulaengine.CalByAstTree(node, benchVars); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFormulaEval(b *testing.B) {
+	f, err := formulaengine.Compile(benchFormula)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Eval(benchVars); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVMRun(b *testing.B) {
+	prog, err := formulaengine.CompileProgram(benchFormula)
+	if err != nil {
+		b.Fatal(err)
+	}
+	vm := prog.NewVM()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := vm.Run(benchVars); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProgramEvalParallel(b *testing.B) {
+	prog, err := formulaengine.CompileProgram(benchFormula)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := prog.Eval(benchVars); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package test
+
+import (
+	formulaengine "e.coding.net/oiine/backend/formula-engine"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"testing"
+)
+
+func double(ps ...formulaengine.Value) (formulaengine.Value, error) {
+	d, ok := ps[0].Number()
+	if !ok {
+		return formulaengine.Value{}, fmt.Errorf("expected number, got %s", ps[0].Kind())
+	}
+	return formulaengine.NumberValue(d.Mul(decimal.NewFromInt(2))), nil
+}
+
+func TestEngineIsolation(t *testing.T) {
+	e1 := formulaengine.NewEngine(formulaengine.WithFunc("double", formulaengine.FuncSpec{MinArgs: 1, MaxArgs: 1, Impl: double}))
+	e2 := formulaengine.NewEngine()
+
+	node, err := e1.GetAstTreeByString("DOUBLE({a})+MAX(1,2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := e1.CalByAstTree(node, map[string]string{"a": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Equal(decimal.NewFromInt(8)) {
+		t.Errorf("expected 8, got %s", res)
+	}
+
+	if _, err := e2.GetAstTreeByString("DOUBLE(1)"); err == nil {
+		t.Error("expected unknown function error in e2")
+	}
+	if _, err := formulaengine.GetAstTreeByString("DOUBLE(1)"); err == nil {
+		t.Error("expected unknown function error in default engine")
+	}
+
+	e3 := formulaengine.NewEngine(formulaengine.WithoutBuiltinFuncs())
+	if _, err := e3.GetAstTreeByString("MAX(1,2)"); err == nil {
+		t.Error("expected unknown function error without builtin functions")
+	}
+}
+
+func TestEngineDivisionPrecision(t *testing.T) {
+	e := formulaengine.NewEngine(formulaengine.WithDivisionPrecision(2))
+	node, err := e.GetAstTreeByString("1/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := e.CalByAstTree(node, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.String() != "0.33" {
+		t.Errorf("expected 0.33, got %s", res)
+	}
+}
+
+func TestEngineBinaryOperator(t *testing.T) {
+	// 替换 & 为取两侧的最小值，左侧为0时也不再短路
+	minOp := func(p1, p2 formulaengine.Value) (formulaengine.Value, error) {
+		d1, _ := p1.Number()
+		d2, _ := p2.Number()
+		return formulaengine.NumberValue(decimal.Min(d1, d2)), nil
+	}
+	e := formulaengine.NewEngine(formulaengine.WithBinaryOperator(formulaengine.TTAnd, minOp))
+	str := "0 & {x} & 2"
+	vars := map[string]string{"x": "-1"}
+	node, err := e.GetAstTreeByString(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, v formulaengine.Value, err error) {
+		t.Helper()
+		if err != nil || v.String() != "-1" {
+			t.Errorf("%s: expected -1, got %v, %v", name, v, err)
+		}
+	}
+	v, err := e.CalValueByAstTree(node, vars)
+	check("interpreter", v, err)
+	f, err := e.CompileAstTree(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = f.Eval(vars)
+	check("formula", v, err)
+	p, err := e.CompileProgramAstTree(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = p.Eval(vars)
+	check("program", v, err)
+	vals, errs := formulaengine.EvaluateColumns(f, map[string][]decimal.Decimal{"x": {decimal.NewFromInt(-1)}})
+	check("columns", vals[0], errs[0])
+	optimized, _ := e.Optimize(node)
+	v, err = e.CalValueByAstTree(optimized, vars)
+	check("optimized", v, err)
+}
+
+func TestRegisterFunction(t *testing.T) {
+	e := formulaengine.NewEngine()
+	spec := formulaengine.FuncSpec{MinArgs: 1, MaxArgs: 2, Impl: double}
+	if err := e.RegisterFunction("BAD_NAME", spec); err == nil {
+		t.Error("expected invalid name error")
+	}
+	if err := e.RegisterFunction("NOIMPL", formulaengine.FuncSpec{MinArgs: 1, MaxArgs: 1}); err == nil {
+		t.Error("expected missing impl error")
+	}
+	if err := e.RegisterFunction("double", spec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.GetAstTreeByString("DOUBLE(1,2,3)"); err == nil {
+		t.Error("expected arity error")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = e.RegisterFunction("TMP", spec)
+			e.UnregisterFunction("TMP")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		node, err := e.GetAstTreeByString("DOUBLE(2)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.CalByAstTree(node, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	if !e.UnregisterFunction("DOUBLE") {
+		t.Error("expected DOUBLE to be registered")
+	}
+	for _, info := range e.ListFunctions() {
+		if info.Name == "DOUBLE" {
+			t.Error("DOUBLE should be unregistered")
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package test
+
+import (
+	formulaengine "e.coding.net/oiine/backend/formula-engine"
+	"errors"
+	"testing"
+)
+
+func TestTypedErrors(t *testing.T) {
+	if _, err := formulaengine.GetAstTreeByString("1 + $"); err != nil {
+		var lexErr *formulaengine.LexError
+		if !errors.As(err, &lexErr) || lexErr.Span != (formulaengine.Span{Start: 4, End: 4, StartRune: 4, EndRune: 4}) || lexErr.Token != "$" {
+			t.Errorf("expected LexError at 4, got %#v", err)
+		}
+	} else {
+		t.Error("expected lex error")
+	}
+
+	if _, err := formulaengine.GetAstTreeByString("(1 + 2"); err != nil {
+		var synErr *formulaengine.SyntaxError
+		if !errors.As(err, &synErr) || synErr.Span.Start != 6 {
+			t.Errorf("expected SyntaxError at 6, got %#v", err)
+		}
+	} else {
+		t.Error("expected syntax error")
+	}
+
+	if _, err := formulaengine.GetAstTreeByString("1 + IF(1, 2)"); err != nil {
+		var arityErr *formulaengine.ArityError
+		if !errors.As(err, &arityErr) || arityErr.Func != "IF" || arityErr.Got != 2 || arityErr.Span.Start != 4 {
+			t.Errorf("expected ArityError for IF, got %#v", err)
+		}
+	} else {
+		t.Error("expected arity error")
+	}
+
+	node, err := formulaengine.GetAstTreeByString("MAX(1, {a} / 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = formulaengine.CalByAstTree(node, map[string]string{"a": "1"})
+	var divErr *formulaengine.DivisionByZeroError
+	if !errors.As(err, &divErr) || divErr.Span != (formulaengine.Span{Start: 11, End: 11, StartRune: 11, EndRune: 11}) {
+		t.Errorf("expected DivisionByZeroError at 11, got %#v", err)
+	}
+
+	node, err = formulaengine.GetAstTreeByString(`1 + UPPER("a")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = formulaengine.CalByAstTree(node, nil)
+	var evalErr *formulaengine.EvalError
+	if !errors.As(err, &evalErr) || evalErr.Span.Start != 2 {
+		t.Errorf("expected EvalError at 2, got %#v", err)
+	}
+
+	// 函数返回的同一个错误在不同位置、并发计算时分别定位，不修改原错误
+	shared := &formulaengine.EvalError{ErrorInfo: formulaengine.ErrorInfo{Kind: "Illegal Calculation", Msg: "shared"}}
+	e := formulaengine.NewEngine(formulaengine.WithFunc("FAIL", formulaengine.FuncSpec{MinArgs: 0, MaxArgs: 0,
+		Impl: func(...formulaengine.Value) (formulaengine.Value, error) { return formulaengine.Value{}, shared }}))
+	done := make(chan struct{})
+	for _, c := range []struct {
+		str   string
+		start int
+	}{{"FAIL()", 0}, {"1 + FAIL()", 4}, {"1 + 2 * FAIL()", 8}} {
+		f, err := e.Compile(c.str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(f *formulaengine.Formula, start int) {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 100; i++ {
+				_, err := f.Eval(nil)
+				var evalErr *formulaengine.EvalError
+				if !errors.As(err, &evalErr) || evalErr.Span.Start != start || evalErr.Func != "FAIL" {
+					t.Errorf("expected EvalError at %d, got %#v", start, err)
+					return
+				}
+			}
+		}(f, c.start)
+	}
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	if shared.Located || shared.Func != "" {
+		t.Errorf("shared error was modified: %#v", shared)
+	}
+}
+
+func TestParseWithRecovery(t *testing.T) {
+	node, errs := formulaengine.ParseWithRecovery("1 + $ + FOO(1) * IF(1, 2) + (2")
+	if node == nil {
+		t.Fatal("expected partial ast")
+	}
+	starts := []int{4, 8, 17, 30}
+	if len(errs) != len(starts) {
+		t.Fatalf("expected %d errors, got %v", len(starts), errs)
+	}
+	var lexErr *formulaengine.LexError
+	var arityErr *formulaengine.ArityError
+	if !errors.As(errs[0], &lexErr) || !errors.As(errs[2], &arityErr) {
+		t.Errorf("unexpected error types: %v", errs)
+	}
+	for idx, err := range errs {
+		var synErr *formulaengine.SyntaxError
+		if errors.As(err, &synErr) && synErr.Span.Start != starts[idx] {
+			t.Errorf("error %d: expected start %d, got %v", idx, starts[idx], err)
+		}
+	}
+	if _, err := formulaengine.CalByAstTree(node, nil); err == nil {
+		t.Error("expected error when calculating a partial ast")
+	}
+
+	node, errs = formulaengine.ParseWithRecovery("MAX(1, 2) + 1")
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if res, err := formulaengine.CalByAstTree(node, nil); err != nil || res.String() != "3" {
+		t.Errorf("expected 3, got %v, %v", res, err)
+	}
+
+	// 多余的token、非法字符不在树中，部分ast树计算、编译时仍报错，格式化为原文
+	for _, str := range []string{"1 2 3", "((1)", "MAX(1 2)", "MAX(1))", "{a}}", "1 +", "MAX(1,"} {
+		node, errs := formulaengine.ParseWithRecovery(str)
+		if len(errs) == 0 {
+			t.Errorf("%s: expected errors", str)
+			continue
+		}
+		if _, err := formulaengine.CalValueByAstTree(node, map[string]string{"a": "1"}); err == nil {
+			t.Errorf("%s: expected error when calculating a partial ast", str)
+		}
+		if _, err := formulaengine.DefaultEngine().CompileAstTree(node); err == nil {
+			t.Errorf("%s: expected error when compiling a partial ast", str)
+		}
+		if _, err := formulaengine.DefaultEngine().CompileProgramAstTree(node); err == nil {
+			t.Errorf("%s: expected error when compiling a partial ast to a program", str)
+		}
+		if got := formulaengine.Format(node); got != str {
+			t.Errorf("%s: unexpected format %s", str, got)
+		}
+		illegal, ok := formulaengine.ToExpr(node).(*formulaengine.IllegalExpr)
+		if !ok || illegal.Text() != str || illegal.Partial() == nil {
+			t.Errorf("%s: expected an illegal root wrapping the partial ast", str)
+		}
+	}
+	node, _ = formulaengine.ParseWithRecovery("1 +")
+	if partial := formulaengine.ToExpr(node).(*formulaengine.IllegalExpr).Partial(); formulaengine.Format(partial.Node()) != "1 + " {
+		t.Errorf("unexpected partial ast %s", formulaengine.Format(partial.Node()))
+	}
+}
+
+func TestUnicode(t *testing.T) {
+	vars := map[string]string{"数量": "3", "单价": "2.5"}
+	res, err := calString(t, "（{数量} ＋ 1）＊｛单价｝ ＞ 9 ＆ ！（{数量}＝0）", vars)
+	if err != nil || res != "1" {
+		t.Errorf("expected 1, got %s, %v", res, err)
+	}
+	// 字符串中的全角字符保持原样
+	if res, err := calString(t, `LEN("（，）") + LEN('数量')`, nil); err != nil || res != "5" {
+		t.Errorf("expected 5, got %s, %v", res, err)
+	}
+
+	_, err = formulaengine.GetAstTreeByString("{数量} + ＄")
+	var lexErr *formulaengine.LexError
+	if !errors.As(err, &lexErr) {
+		t.Fatalf("expected LexError, got %v", err)
+	}
+	// "{数量} + " 共11字节、7个字符，＄占3字节
+	expected := formulaengine.Span{Start: 11, End: 13, StartRune: 7, EndRune: 7}
+	if lexErr.Span != expected || lexErr.Token != "＄" {
+		t.Errorf("expected %+v, got %+v %q", expected, lexErr.Span, lexErr.Token)
+	}
+}
@@ -0,0 +1,632 @@
+package test
+
+import (
+	"context"
+	formulaengine "e.coding.net/oiine/backend/formula-engine"
+	"errors"
+	"github.com/shopspring/decimal"
+	"math"
+	"testing"
+	"time"
+)
+
+func calString(t *testing.T, str string, vars map[string]string) (string, error) {
+	t.Helper()
+	node, err := formulaengine.GetAstTreeByString(str)
+	if err != nil {
+		t.Fatalf("%s: %v", str, err)
+	}
+	res, err := formulaengine.CalByAstTree(node, vars)
+	if err != nil {
+		return "", err
+	}
+	return res.String(), nil
+}
+
+func TestShortCircuit(t *testing.T) {
+	cases := []struct {
+		str  string
+		want string
+	}{
+		{"IF({x}=0, 0, 1/{x})", "0"},
+		{"IF({x}!=0, 1/{x}, 5)", "5"},
+		{"{x}=1 & 1/{x}>0", "0"},
+		{"{x}=0 | 1/{x}>0", "1"},
+		{"AND({x}, 1/{x})", "0"},
+		{"OR(1, 1/{x})", "1"},
+		{"AND(1, 2>1, 3)", "1"},
+		{"OR(0, 2<1)", "0"},
+	}
+	vars := map[string]string{"x": "0"}
+	for _, c := range cases {
+		got, err := calString(t, c.str, vars)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.str, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: expected %s, got %s", c.str, c.want, got)
+		}
+	}
+
+	if _, err := calString(t, "IF({x}=0, 1/{x}, 0)", vars); err == nil {
+		t.Error("expected divide by 0 error from the chosen branch")
+	}
+}
+
+func TestValueTypes(t *testing.T) {
+	vars := map[string]string{"n": "2", "s": "abc", "blank": ""}
+	cases := []struct {
+		str  string
+		kind formulaengine.Kind
+		want string
+	}{
+		{"1>0", formulaengine.KindBool, "TRUE"},
+		{"TRUE() & !FALSE()", formulaengine.KindBool, "TRUE"},
+		{"{n}*2", formulaengine.KindNumber, "4"},
+		{"{s}", formulaengine.KindString, "abc"},
+		{"{blank}+1", formulaengine.KindNull, ""},
+		{"MAX({blank}, 3, {n})", formulaengine.KindNumber, "3"},
+		{"(1>0)=1", formulaengine.KindBool, "TRUE"},
+	}
+	for _, c := range cases {
+		node, err := formulaengine.GetAstTreeByString(c.str)
+		if err != nil {
+			t.Fatalf("%s: %v", c.str, err)
+		}
+		v, err := formulaengine.CalValueByAstTree(node, vars)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.str, err)
+			continue
+		}
+		if v.Kind() != c.kind || v.String() != c.want {
+			t.Errorf("%s: expected %s %q, got %s %q", c.str, c.kind, c.want, v.Kind(), v.String())
+		}
+	}
+
+	// 空值结果不能转为Decimal
+	f, err := formulaengine.Compile("{a}+{blank}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.EvalDecimal(vars); err == nil {
+		t.Error("EvalDecimal: expected error for a null result")
+	}
+	var evalErr *formulaengine.EvalError
+	if _, err := formulaengine.CalByAstTree(f.AstTree(), vars); !errors.As(err, &evalErr) {
+		t.Errorf("CalByAstTree: expected EvalError for a null result, got %v", err)
+	}
+
+	for _, str := range []string{"{s}+1", "(1>0)+1", "!{s}", "{s}>1"} {
+		if _, err := calString(t, str, vars); err == nil {
+			t.Errorf("%s: expected type error", str)
+		}
+	}
+}
+
+func TestStrings(t *testing.T) {
+	vars := map[string]string{"status": "ACTIVE", "name": "  张三 ", "amount": "1234567.891"}
+	cases := []struct {
+		str  string
+		want string
+	}{
+		{`{status} = "ACTIVE"`, "TRUE"},
+		{`{status} != 'ACTIVE'`, "FALSE"},
+		{`"abc" < "abd"`, "TRUE"},
+		{`"a\"b" + 'c\'d\\'`, `a"bc'd\`},
+		{`LEN(TRIM({name}))`, "2"},
+		{`UPPER("abc") + LOWER("DEF")`, "ABCdef"},
+		{`LEFT("hello") + RIGHT("hello", 2) + MID("hello", 2, 3)`, "hloell"},
+		{`MID("abc", 2, 9223372036854775807) + MID("abc", 9223372036854775807, 1)`, "bc"},
+		{`LEFT("abc", 9223372036854775807) + RIGHT("abc", 9223372036854775807)`, "abcabc"},
+		{`CONCAT("n=", 1.5, TRUE())`, "n=1.5TRUE"},
+		{`SUBSTITUTE("a-b-c", "-", "+")`, "a+b+c"},
+		{`SUBSTITUTE("a-b-c", "-", "+", 2)`, "a-b+c"},
+		{`FIND("c", "abcabc", 4)`, "6"},
+		{`TEXT({amount}, "#,##0.00")`, "1,234,567.89"},
+		{`TEXT(0.256, "0.0%")`, "25.6%"},
+		{`TEXT(-1234, "#,##0")`, "-1,234"},
+	}
+	for _, c := range cases {
+		node, err := formulaengine.GetAstTreeByString(c.str)
+		if err != nil {
+			t.Fatalf("%s: %v", c.str, err)
+		}
+		v, err := formulaengine.CalValueByAstTree(node, vars)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.str, err)
+			continue
+		}
+		if v.String() != c.want {
+			t.Errorf("%s: expected %q, got %q", c.str, c.want, v.String())
+		}
+	}
+
+	for _, str := range []string{`"abc`, `"a\qb"`} {
+		if _, err := formulaengine.GetAstTreeByString(str); err == nil {
+			t.Errorf("%s: expected lex error", str)
+		}
+	}
+	if _, err := calString(t, `"a" = 1`, nil); err == nil {
+		t.Error("expected type error comparing string with number")
+	}
+	if _, err := calString(t, `FIND("x", "abc")`, nil); err == nil {
+		t.Error("expected not found error")
+	}
+	for _, str := range []string{`TEXT(1, "abc")`, `TEXT(1, "")`, `TEXT(1, "0.#")`, `TEXT(1, ",0")`, `TEXT(1, "0%%")`} {
+		_, err := calString(t, str, nil)
+		var evalErr *formulaengine.EvalError
+		if !errors.As(err, &evalErr) {
+			t.Errorf("%s: expected unsupported format error, got %v", str, err)
+		}
+	}
+	for _, str := range []string{`LEFT("abc", 1e19)`, `RIGHT("abc", -1e19)`, `MID("abc", 1e19, 1)`, `MID("abc", 1, 1e19)`, `FIND("a", "abc", 1e19)`, `FIND("a", "abc", 9223372036854775807)`} {
+		if _, err := calString(t, str, nil); err == nil {
+			t.Errorf("%s: expected out of range error", str)
+		}
+	}
+}
+
+func TestMissingVariable(t *testing.T) {
+	node, err := formulaengine.GetAstTreeByString("{price}*{qty}+1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"qty": "2"}
+
+	v, err := formulaengine.CalValueByAstTree(node, vars)
+	if err != nil || v.String() != "1" {
+		t.Errorf("default policy: expected 1, got %s, %v", v, err)
+	}
+	if _, err := formulaengine.CalValueByAstTree(node, vars, formulaengine.WithMissingVariable(formulaengine.MissingError)); err == nil {
+		t.Error("error policy: expected error")
+	}
+	v, err = formulaengine.CalValueByAstTree(node, vars, formulaengine.WithMissingVariable(formulaengine.MissingNull))
+	if err != nil || !v.IsNull() {
+		t.Errorf("null policy: expected null, got %s, %v", v, err)
+	}
+	v, err = formulaengine.CalValueByAstTree(node, vars,
+		formulaengine.WithMissingVariable(formulaengine.MissingError),
+		formulaengine.WithVariableDefaults(map[string]formulaengine.Value{"price": formulaengine.NumberValue(decimal.NewFromInt(3))}),
+	)
+	if err != nil || v.String() != "7" {
+		t.Errorf("defaults: expected 7, got %s, %v", v, err)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	f, err := formulaengine.Compile(`IF({x}=0, 0, 1/{x}) + LEN({s})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		go func(g int) {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 100; i++ {
+				res, err := f.EvalDecimal(map[string]string{"x": "4", "s": "ab"})
+				if err != nil || res.String() != "2.25" {
+					t.Errorf("expected 2.25, got %v, %v", res, err)
+					return
+				}
+			}
+		}(g)
+	}
+	for g := 0; g < 4; g++ {
+		<-done
+	}
+
+	v, err := f.Eval(map[string]string{"x": "1"}, formulaengine.WithMissingVariable(formulaengine.MissingNull))
+	if err != nil || v.String() != "1" {
+		t.Errorf("expected 1, got %v, %v", v, err)
+	}
+	if _, err := f.Eval(nil, formulaengine.WithMissingVariable(formulaengine.MissingError)); err == nil {
+		t.Error("expected missing variable error")
+	}
+}
+
+func TestEvaluateColumns(t *testing.T) {
+	f, err := formulaengine.Compile(`IF({x}=0, -1, {y}/{x}) + 1/{y}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := func(vals ...int64) []decimal.Decimal {
+		res := make([]decimal.Decimal, 0, len(vals))
+		for _, v := range vals {
+			res = append(res, decimal.NewFromInt(v))
+		}
+		return res
+	}
+	vals, errs := formulaengine.EvaluateColumns(f, map[string][]decimal.Decimal{
+		"x": dec(2, 0, 4, 5),
+		"y": dec(4, 1, 0),
+	}, formulaengine.WithMissingVariable(formulaengine.MissingError))
+	if len(vals) != 4 || len(errs) != 4 {
+		t.Fatalf("expected 4 rows, got %d, %d", len(vals), len(errs))
+	}
+	for i, expected := range []string{"2.25", "0"} {
+		if errs[i] != nil || vals[i].String() != expected {
+			t.Errorf("row %d: expected %s, got %v, %v", i, expected, vals[i], errs[i])
+		}
+	}
+	// 第3行除0，第4行缺少y，不影响其他行
+	var divErr *formulaengine.DivisionByZeroError
+	if !errors.As(errs[2], &divErr) {
+		t.Errorf("row 2: expected division by zero, got %v", errs[2])
+	}
+	if errs[3] == nil {
+		t.Error("row 3: expected missing variable error")
+	}
+
+	// 出错的行的值为空值，不保留复用缓冲中的值
+	f, err = formulaengine.Compile(`{a} * ({b} / {c})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, errs = formulaengine.EvaluateColumns(f, map[string][]decimal.Decimal{
+		"a": dec(1, 1), "b": dec(2, 2), "c": dec(1, 0),
+	})
+	if errs[0] != nil || vals[0].String() != "2" {
+		t.Errorf("row 0: expected 2, got %v, %v", vals[0], errs[0])
+	}
+	if errs[1] == nil || !vals[1].IsNull() {
+		t.Errorf("row 1: expected null with an error, got %v, %v", vals[1], errs[1])
+	}
+
+	// 未被选中的分支、短路的右侧不计算
+	calls := 0
+	e := formulaengine.NewEngine(formulaengine.WithFunc("COUNT", formulaengine.FuncSpec{MinArgs: 1, MaxArgs: 1,
+		Impl: func(ps ...formulaengine.Value) (formulaengine.Value, error) {
+			calls++
+			return ps[0], nil
+		}}))
+	f, err = e.Compile(`IF({x} > 0, COUNT({x}), 0) + COUNT(1 / {x} + COUNT({x}))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, errs = formulaengine.EvaluateColumns(f, map[string][]decimal.Decimal{"x": dec(2, 1, 0)})
+	if calls != 6 {
+		t.Errorf("expected 6 calls, got %d", calls)
+	}
+	if errs[2] == nil || vals[0].String() != "4.5" || vals[1].String() != "3" {
+		t.Errorf("unexpected results %v, %v", vals, errs)
+	}
+	calls = 0
+	f, err = e.Compile(`{x} > 1 & COUNT({x}) > 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, _ = formulaengine.EvaluateColumns(f, map[string][]decimal.Decimal{"x": dec(2, 1, 0)})
+	if calls != 1 || vals[0].String() != "TRUE" || vals[2].String() != "FALSE" {
+		t.Errorf("expected 1 call, got %d, %v", calls, vals)
+	}
+
+	// 不支持计算限制
+	_, errs = formulaengine.EvaluateColumns(f, map[string][]decimal.Decimal{"x": dec(1)}, formulaengine.WithMaxSteps(10))
+	if errs[0] == nil {
+		t.Error("expected an error for evaluation limits")
+	}
+}
+
+func TestNumberLiterals(t *testing.T) {
+	cases := map[string]string{
+		"1.5e-3":      "0.0015",
+		"2E+3 + 1e2":  "2100",
+		".5 * 2":      "1",
+		"1_000_000":   "1000000",
+		"12% * 200":   "24",
+		"-5%":         "-0.05",
+		"2 ^ 200%":    "4",
+		"50%%":        "0.005",
+		"({x} + 1)%":  "0.04",
+		"1_0.2_5e0_1": "102.5",
+	}
+	for str, expected := range cases {
+		res, err := calString(t, str, map[string]string{"x": "3"})
+		if err != nil || res != expected {
+			t.Errorf("%s: expected %s, got %s, %v", str, expected, res, err)
+		}
+	}
+	for _, str := range []string{"1__0", "1_", "1._5", "1.", "1e", "1e+", "1e2.5", "1.2.3", "."} {
+		if _, err := formulaengine.GetAstTreeByString(str); err == nil {
+			t.Errorf("%s: expected error", str)
+		}
+	}
+	_, err := formulaengine.GetAstTreeByString("1 + 2e999999999999")
+	var lexErr *formulaengine.LexError
+	if !errors.As(err, &lexErr) || lexErr.Span.Start != 4 || lexErr.Span.End != 17 {
+		t.Errorf("expected a located out of range error, got %v", err)
+	}
+	// 指数的绝对值不超过10000
+	for _, str := range []string{"1e999999999", "1e99999999 + 1", "1e10001", "1e-10001", "0.5e1_0001"} {
+		if _, err := formulaengine.GetAstTreeByString(str); !errors.As(err, &lexErr) || lexErr.Span.Start != 0 {
+			t.Errorf("%s: expected a located out of range error, got %v", str, err)
+		}
+	}
+	for _, str := range []string{"1e10000", "1e-10000", "1e0_010_000"} {
+		if _, err := formulaengine.GetAstTreeByString(str); err != nil {
+			t.Errorf("%s: unexpected error %v", str, err)
+		}
+	}
+	node, _ := formulaengine.GetAstTreeByString("-{x}% + (-{x})% + 1_000.5e1")
+	if got := formulaengine.Format(node); got != "-{x}% + (-{x})% + 1000.5e1" {
+		t.Errorf("unexpected format %s", got)
+	}
+}
+
+func TestQuotedVariables(t *testing.T) {
+	str := `{"Unit Price (USD)"} * {order.total} + {'a\'}b'}`
+	vars := map[string]string{"Unit Price (USD)": "2", "order.total": "3", "a'}b": "1"}
+	if res, err := calString(t, str, vars); err != nil || res != "7" {
+		t.Errorf("expected 7, got %s, %v", res, err)
+	}
+	node, err := formulaengine.GetAstTreeByString(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formulaengine.Variables(node); len(got) != 3 || got[0] != "Unit Price (USD)" || got[2] != "a'}b" {
+		t.Errorf("unexpected variables %q", got)
+	}
+	if got := formulaengine.Format(node); got != `{"Unit Price (USD)"} * {order.total} + {"a'}b"}` {
+		t.Errorf("unexpected format %s", got)
+	}
+	// '}'只能直接写在引号中，不支持 \} 转义
+	if res, err := calString(t, `{"a}b"} + 1`, map[string]string{"a}b": "1"}); err != nil || res != "2" {
+		t.Errorf("expected 2, got %s, %v", res, err)
+	}
+	for _, str := range []string{"{a.}", "{.a}", "{a..b}", `{""}`, `{"a}`, `{"a"b}`, `{a\}b}`, `{"a\}b"}`} {
+		if _, err := formulaengine.GetAstTreeByString(str); err == nil {
+			t.Errorf("%s: expected error", str)
+		}
+	}
+}
+
+type pathCustomer struct {
+	Tier string `json:"tier"`
+}
+
+type pathOrder struct {
+	Customer *pathCustomer `formula:"customer"`
+	Items    []map[string]any
+}
+
+func TestPathVariables(t *testing.T) {
+	data := map[string]any{
+		"order": pathOrder{
+			Customer: &pathCustomer{Tier: "gold"},
+			Items:    []map[string]any{{"qty": 1}, {"qty": 2.5}, {"qty": decimal.NewFromInt(4)}},
+		},
+		"items": []any{map[string]any{"qty": 3}, nil},
+		"x.y":   7,
+	}
+	cases := map[string]string{
+		`IF({order.customer.tier} = "gold", 1, 0)`:    "1",
+		`{order.items[1].qty} + {order.items[2].qty}`: "6.5",
+		`{items[0].qty} * {x.y}`:                      "21",
+	}
+	for str, expected := range cases {
+		node, err := formulaengine.GetAstTreeByString(str)
+		if err != nil {
+			t.Fatalf("%s: %v", str, err)
+		}
+		res, err := formulaengine.CalValueByData(node, data)
+		if err != nil {
+			t.Errorf("%s: %v", str, err)
+			continue
+		}
+		if got := res.String(); got != expected {
+			t.Errorf("%s: expected %s, got %s", str, expected, got)
+		}
+		if got := formulaengine.Format(node); got != str {
+			t.Errorf("%s: unexpected format %s", str, got)
+		}
+	}
+
+	f, err := formulaengine.Compile(`{order.items[5].qty} + 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := f.EvalData(data); err != nil || res.String() != "1" {
+		t.Errorf("expected 1 with MissingZero, got %v, %v", res, err)
+	}
+	_, err = f.EvalData(data, formulaengine.WithMissingVariable(formulaengine.MissingError))
+	var pathErr *formulaengine.PathError
+	if !errors.As(err, &pathErr) || !pathErr.NotFound || pathErr.Segment != "[5]" {
+		t.Errorf("expected missing segment [5], got %v", err)
+	}
+	var evalErr *formulaengine.EvalError
+	if !errors.As(err, &evalErr) || evalErr.Span.Start != 1 {
+		t.Errorf("expected a located EvalError, got %v", err)
+	}
+
+	f, err = formulaengine.Compile(`{order.customer.tier.name}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.EvalData(data, formulaengine.WithMissingVariable(formulaengine.MissingNull))
+	if !errors.As(err, &pathErr) || pathErr.NotFound || pathErr.Segment != "name" {
+		t.Errorf("expected a type error at segment name, got %v", err)
+	}
+
+	for _, x := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		node, err := formulaengine.GetAstTreeByString("{items[1].x} + 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = formulaengine.CalValueByData(node, map[string]any{"items": []any{nil, map[string]any{"x": x}}})
+		if !errors.As(err, &pathErr) || pathErr.NotFound || pathErr.Segment != "x" {
+			t.Errorf("%v: expected a non-finite number error at segment x, got %v", x, err)
+		}
+	}
+
+	for _, str := range []string{"{a[}", "{a[]}", "{a[1}", "{a[x]}", "{[1]}"} {
+		if _, err := formulaengine.GetAstTreeByString(str); err == nil {
+			t.Errorf("%s: expected error", str)
+		}
+	}
+}
+
+func TestResolver(t *testing.T) {
+	str := `IF({flag} > 0, {a} * {b.c}, {expensive})`
+	node, err := formulaengine.GetAstTreeByString(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolvers := []formulaengine.Resolver{
+		formulaengine.StringMapResolver{"flag": "1", "a": "2", "b.c": "3"},
+		formulaengine.AnyMapResolver{"flag": 1, "a": 2, "b": map[string]any{"c": 3}},
+		formulaengine.NewDataResolver(struct {
+			Flag int
+			A    int `formula:"a"`
+			B    struct{ C float64 }
+		}{Flag: 1, A: 2, B: struct{ C float64 }{C: 3}}),
+	}
+	for _, r := range resolvers {
+		if res, err := formulaengine.CalValueByResolver(context.Background(), node, r); err != nil || res.String() != "6" {
+			t.Errorf("%T: expected 6, got %v, %v", r, res, err)
+		}
+	}
+
+	// 只获取计算到的变量
+	var names []string
+	counting := formulaengine.ResolverFunc(func(ctx context.Context, name string) (formulaengine.Value, error) {
+		names = append(names, name)
+		return formulaengine.DecimalMapResolver{"a": decimal.NewFromInt(2), "b.c": decimal.NewFromInt(3)}.Resolve(ctx, name)
+	})
+	f, err := formulaengine.Compile(`IF(1 < 2, {a} * {b.c}, {expensive})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := f.EvalResolver(context.Background(), counting); err != nil || res.String() != "6" {
+		t.Errorf("expected 6, got %v, %v", res, err)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b.c" {
+		t.Errorf("unexpected resolved variables %q", names)
+	}
+
+	// ErrNotFound 按 MissingPolicy 处理，其他错误直接返回
+	prog, err := formulaengine.CompileProgram(`{missing} + 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := formulaengine.StringMapResolver{}
+	if res, err := prog.Eval(nil, formulaengine.WithResolver(empty)); err != nil || res.String() != "1" {
+		t.Errorf("expected 1 with MissingZero, got %v, %v", res, err)
+	}
+	_, err = prog.Eval(nil, formulaengine.WithResolver(empty), formulaengine.WithMissingVariable(formulaengine.MissingError))
+	var evalErr *formulaengine.EvalError
+	if !errors.As(err, &evalErr) || evalErr.Span.Start != 1 {
+		t.Errorf("expected a located EvalError, got %v", err)
+	}
+	failed := errors.New("connection refused")
+	failing := formulaengine.ResolverFunc(func(context.Context, string) (formulaengine.Value, error) {
+		return formulaengine.Value{}, failed
+	})
+	if _, err := f.EvalResolver(context.Background(), failing); !errors.Is(err, failed) {
+		t.Errorf("expected resolver error, got %v", err)
+	}
+}
+
+func TestEvalLimits(t *testing.T) {
+	// 忽略参数错误的惰性函数，不能绕过限制
+	e := formulaengine.NewEngine(formulaengine.WithFunc("TRY", formulaengine.FuncSpec{MinArgs: 2, MaxArgs: 2, Lazy: func(args ...formulaengine.Thunk) (formulaengine.Value, error) {
+		if res, err := args[0](); err == nil {
+			return res, nil
+		}
+		return args[1]()
+	}}))
+	evals := map[string]func(str string, opts ...formulaengine.EvalOption) (formulaengine.Value, error){
+		"interpreter": func(str string, opts ...formulaengine.EvalOption) (formulaengine.Value, error) {
+			node, err := e.GetAstTreeByString(str)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return e.EvalContext(context.Background(), node, nil, opts...)
+		},
+		"formula": func(str string, opts ...formulaengine.EvalOption) (formulaengine.Value, error) {
+			f, err := e.Compile(str)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f.EvalContext(context.Background(), nil, opts...)
+		},
+		"program": func(str string, opts ...formulaengine.EvalOption) (formulaengine.Value, error) {
+			p, err := e.CompileProgram(str)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p.EvalContext(context.Background(), nil, opts...)
+		},
+	}
+	cases := []struct {
+		str   string
+		opt   formulaengine.EvalOption
+		limit formulaengine.LimitKind
+	}{
+		{"9^9^9^9", formulaengine.WithMaxDigits(1000), formulaengine.LimitDigits},
+		{"TRY(9^9^9, 0)", formulaengine.WithMaxDigits(1000), formulaengine.LimitDigits},
+		{"123456 * 123456", formulaengine.WithMaxDigits(10), formulaengine.LimitDigits},
+		{"1+1+1+1+1+1+1+1+1+1", formulaengine.WithMaxSteps(10), formulaengine.LimitSteps},
+		{"TRY(1+1+1+1+1+1+1+1+1+1, 0)", formulaengine.WithMaxSteps(10), formulaengine.LimitSteps},
+		{"-(-(-(-(-1))))", formulaengine.WithMaxDepth(4), formulaengine.LimitDepth},
+	}
+	for name, eval := range evals {
+		for _, c := range cases {
+			_, err := eval(c.str, c.opt)
+			var limitErr *formulaengine.LimitError
+			if !errors.As(err, &limitErr) || limitErr.Limit != c.limit {
+				t.Errorf("%s %s: expected %s limit error, got %v", name, c.str, c.limit, err)
+			}
+		}
+		res, err := eval("MAX(9^9, -(-(2)), 1+1)", formulaengine.WithMaxDigits(9), formulaengine.WithMaxSteps(100), formulaengine.WithMaxDepth(4))
+		if err != nil || res.String() != "387420489" {
+			t.Errorf("%s: expected 387420489 within limits, got %v, %v", name, res, err)
+		}
+	}
+
+	// 只设置超时，乘方也能被中断
+	for name := range evals {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		start := time.Now()
+		var err error
+		switch name {
+		case "interpreter":
+			node, _ := e.GetAstTreeByString("9^9^9^9")
+			_, err = e.EvalContext(ctx, node, nil)
+		case "formula":
+			f, _ := e.Compile("9^9^9^9")
+			_, err = f.EvalContext(ctx, nil)
+		case "program":
+			p, _ := e.CompileProgram("9^9^9^9")
+			_, err = p.EvalContext(ctx, nil)
+		}
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected deadline exceeded, got %v", name, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: returned after %s", name, elapsed)
+		}
+	}
+	live, stop := context.WithCancel(context.Background())
+	defer stop()
+	node, err := formulaengine.GetAstTreeByString("2^10 + 1.5^3 + (-2)^3 + 2^-2 + 7^0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := formulaengine.EvalContext(live, node, nil); err != nil || res.String() != "1020.625" {
+		t.Errorf("expected 1020.625, got %v, %v", res, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f, err := formulaengine.Compile("1 + 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.EvalContext(ctx, nil)
+	var limitErr *formulaengine.LimitError
+	if !errors.Is(err, context.Canceled) || !errors.As(err, &limitErr) || limitErr.Limit != formulaengine.LimitContext {
+		t.Errorf("expected canceled, got %v", err)
+	}
+}
@@ -1,17 +1,39 @@
 package formula_engine
 
 type token struct {
-	Type  TT
-	Value string
-	Start int
-	End   int
+	Type      TT
+	Value     string
+	Start     int // 首字节偏移
+	End       int // 末字节偏移（包含）
+	StartRune int // 首字符的字符偏移
+	EndRune   int // 末字符的字符偏移（包含）
 }
 
+// newToken 生成token，字符偏移与字节偏移相同，非ASCII的公式由词法分析器修正
 func newToken(type_ TT, value string, start int, end int) *token {
 	return &token{
-		Type:  type_,
-		Value: value,
-		Start: start,
-		End:   end,
+		Type:      type_,
+		Value:     value,
+		Start:     start,
+		End:       end,
+		StartRune: start,
+		EndRune:   end,
 	}
 }
+
+// newTokenAt 生成位于span的token
+func newTokenAt(type_ TT, value string, span Span) *token {
+	return &token{
+		Type:      type_,
+		Value:     value,
+		Start:     span.Start,
+		End:       span.End,
+		StartRune: span.StartRune,
+		EndRune:   span.EndRune,
+	}
+}
+
+// span token的位置
+func (t *token) span() Span {
+	return Span{Start: t.Start, End: t.End, StartRune: t.StartRune, EndRune: t.EndRune}
+}
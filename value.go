@@ -0,0 +1,251 @@
+package formula_engine
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"math"
+)
+
+// Kind 值类型
+type Kind int
+
+const (
+	KindNull   Kind = iota // 空值，如空字符串变量
+	KindNumber             // 数字
+	KindBool               // 布尔
+	KindString             // 字符串
+	KindError              // 错误
+)
+
+// String 类型名称
+func (k Kind) String() string {
+	switch k {
+	case KindNull:
+		return "null"
+	case KindNumber:
+		return "number"
+	case KindBool:
+		return "bool"
+	case KindString:
+		return "string"
+	case KindError:
+		return "error"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Value 计算过程中的值，带类型标记。零值为空值
+//
+// 类型转换规则：
+//   - 算术运算（+ - * / ^ 及一元 + -）只接受数字，空值参与运算结果为空值，其他类型报错。两个字符串相加时拼接
+//   - 文本函数的参数转化为文本：数字为其十进制表示，布尔为 TRUE、FALSE，空值为空字符串
+//   - 逻辑运算（& | ! 及 IF、AND、OR 的条件）接受布尔和数字，数字非0为真，空值为假，字符串报错
+//   - 比较运算接受数字、布尔（视为0、1），字符串之间按字典序比较，与空值比较结果为空值，其他类型报错
+//   - 错误值参与运算时直接作为结果向上传递
+type Value struct {
+	kind Kind
+	num  decimal.Decimal
+	b    bool
+	str  string
+	err  error
+}
+
+// NullValue 空值
+func NullValue() Value {
+	return Value{kind: KindNull}
+}
+
+// NumberValue 数字值
+func NumberValue(d decimal.Decimal) Value {
+	return Value{kind: KindNumber, num: d}
+}
+
+// BoolValue 布尔值
+func BoolValue(b bool) Value {
+	return Value{kind: KindBool, b: b}
+}
+
+// StringValue 字符串值
+func StringValue(s string) Value {
+	return Value{kind: KindString, str: s}
+}
+
+// ErrorValue 错误值
+func ErrorValue(err error) Value {
+	return Value{kind: KindError, err: err}
+}
+
+// Kind 值类型
+func (v Value) Kind() Kind {
+	return v.kind
+}
+
+// IsNull 是否为空值
+func (v Value) IsNull() bool {
+	return v.kind == KindNull
+}
+
+// Number 数字值，ok 表示是否为数字类型
+func (v Value) Number() (d decimal.Decimal, ok bool) {
+	return v.num, v.kind == KindNumber
+}
+
+// Bool 布尔值，ok 表示是否为布尔类型
+func (v Value) Bool() (b bool, ok bool) {
+	return v.b, v.kind == KindBool
+}
+
+// Str 字符串值，ok 表示是否为字符串类型
+func (v Value) Str() (s string, ok bool) {
+	return v.str, v.kind == KindString
+}
+
+// Err 错误值，非错误类型返回nil
+func (v Value) Err() error {
+	return v.err
+}
+
+// String 值的文本表示
+func (v Value) String() string {
+	switch v.kind {
+	case KindNumber:
+		return v.num.String()
+	case KindBool:
+		if v.b {
+			return "TRUE"
+		}
+		return "FALSE"
+	case KindString:
+		return v.str
+	case KindError:
+		return v.err.Error()
+	}
+	return ""
+}
+
+// Decimal 转化为Decimal类型：布尔为0、1，字符串需能解析为数字，空值报错，错误值返回该错误
+func (v Value) Decimal() (*decimal.Decimal, error) {
+	switch v.kind {
+	case KindNumber:
+		d := v.num
+		return &d, nil
+	case KindBool:
+		d := boolToDecimal(v.b)
+		return &d, nil
+	case KindNull:
+		return nil, newEvalErr(typeErrMsg, "Cannot convert null to number, the result depends on a blank variable")
+	case KindString:
+		d, err := decimal.NewFromString(v.str)
+		if err != nil {
+			return nil, newEvalErr(typeErrMsg, fmt.Sprintf("Cannot convert string '%s' to number", v.str))
+		}
+		return &d, nil
+	}
+	return nil, v.err
+}
+
+// parseVarValue 将变量的字符串值转化为Value：空字符串为空值，能解析为数字的为数字，否则为字符串
+func parseVarValue(s string) Value {
+	if s == "" {
+		return NullValue()
+	}
+	d, err := decimal.NewFromString(s)
+	if err != nil {
+		return StringValue(s)
+	}
+	return NumberValue(d)
+}
+
+// boolToDecimal 将bool值转化为Decimal类型。0为假，1为真
+func boolToDecimal(b bool) decimal.Decimal {
+	if b {
+		return decimal.NewFromInt(1)
+	}
+	return decimal.Zero
+}
+
+// toNumber 算术运算取数字
+func toNumber(v Value) (decimal.Decimal, error) {
+	if v.kind != KindNumber {
+		return decimal.Zero, newEvalErr(typeErrMsg, fmt.Sprintf("Expected number, got %s", v.kind))
+	}
+	return v.num, nil
+}
+
+// toBool 逻辑运算取布尔：数字非0为真，空值为假
+func toBool(v Value) (bool, error) {
+	switch v.kind {
+	case KindBool:
+		return v.b, nil
+	case KindNumber:
+		return !v.num.Equal(decimal.Zero), nil
+	case KindNull:
+		return false, nil
+	case KindError:
+		return false, v.err
+	}
+	return false, newEvalErr(typeErrMsg, fmt.Sprintf("Expected bool, got %s", v.kind))
+}
+
+// toText 文本函数取文本：数字为其十进制表示，布尔为 TRUE、FALSE，空值为空字符串
+func toText(v Value) (string, error) {
+	if v.kind == KindError {
+		return "", v.err
+	}
+	return v.String(), nil
+}
+
+// maxInt、minInt toInt 的取值范围
+var (
+	maxInt = decimal.NewFromInt(math.MaxInt)
+	minInt = decimal.NewFromInt(math.MinInt)
+)
+
+// toInt 取整数参数，如字符串位置、长度
+func toInt(v Value) (int, error) {
+	d, err := toNumber(v)
+	if err != nil {
+		return 0, err
+	}
+	if !d.Equal(d.Truncate(0)) {
+		return 0, newEvalErr(typeErrMsg, fmt.Sprintf("Expected integer, got %s", d))
+	}
+	if d.GreaterThan(maxInt) || d.LessThan(minInt) {
+		return 0, newEvalErr(illegalCalErrMsg, fmt.Sprintf("Integer %s is out of range", d))
+	}
+	return int(d.IntPart()), nil
+}
+
+// toComparable 比较运算取数字：布尔视为0、1
+func toComparable(v Value) (decimal.Decimal, error) {
+	switch v.kind {
+	case KindNumber:
+		return v.num, nil
+	case KindBool:
+		return boolToDecimal(v.b), nil
+	}
+	return decimal.Zero, newEvalErr(typeErrMsg, fmt.Sprintf("Cannot compare %s", v.kind))
+}
+
+// propagateErr 处理错误值的传递。返回的ok为true时，res即为运算结果
+func propagateErr(ps ...Value) (res Value, ok bool) {
+	for _, p := range ps {
+		if p.kind == KindError {
+			return p, true
+		}
+	}
+	return Value{}, false
+}
+
+// propagate 处理空值、错误值的传递。返回的ok为true时，res即为运算结果
+func propagate(ps ...Value) (res Value, ok bool) {
+	if res, ok := propagateErr(ps...); ok {
+		return res, true
+	}
+	for _, p := range ps {
+		if p.kind == KindNull {
+			return p, true
+		}
+	}
+	return Value{}, false
+}
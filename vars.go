@@ -1,7 +1,5 @@
 package formula_engine
 
-import "github.com/shopspring/decimal"
-
 //var (
 //	Digits  = []uint8{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9'}
 //	LoAlpha = []uint8{'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z'}
@@ -12,28 +10,31 @@ type TT string
 
 // TT => token Type
 const (
-	TTNum    TT = "NUM"    // 数字类型
-	TTPlus      = "PLUS"   // + 加号
-	TTMinus     = "MINUS"  // - 减号
-	TTMul       = "MUL"    // * 乘号
-	TTDiv       = "DIV"    // / 除号
-	TTPow       = "POW"    // ^ 乘方
-	TTLparen    = "LPAREN" // ( 左括号
-	TTRparen    = "RPAREN" // ) 右括号
-	TTAnd       = "AND"    // & 与
-	TTOr        = "OR"     // | 或
-	TTNot       = "NOT"    // ! 非
-	TTEq        = "EQ"     // = 等于
-	TTNeq       = "NEQ"    // != 不等于
-	TTGt        = "GT"     // > 大于
-	TTLt        = "LT"     // < 小于
-	TTGte       = "GTE"    // >= 大于等于
-	TTLte       = "LTE"    // <= 小于等于
-	TTComma     = "COMMA"  // , 逗号
+	TTNum     TT = "NUM"     // 数字类型
+	TTString     = "STRING"  // 字符串类型
+	TTPlus       = "PLUS"    // + 加号
+	TTMinus      = "MINUS"   // - 减号
+	TTMul        = "MUL"     // * 乘号
+	TTDiv        = "DIV"     // / 除号
+	TTPow        = "POW"     // ^ 乘方
+	TTLparen     = "LPAREN"  // ( 左括号
+	TTRparen     = "RPAREN"  // ) 右括号
+	TTAnd        = "AND"     // & 与
+	TTOr         = "OR"      // | 或
+	TTNot        = "NOT"     // ! 非
+	TTEq         = "EQ"      // = 等于
+	TTNeq        = "NEQ"     // != 不等于
+	TTGt         = "GT"      // > 大于
+	TTLt         = "LT"      // < 小于
+	TTGte        = "GTE"     // >= 大于等于
+	TTLte        = "LTE"     // <= 小于等于
+	TTComma      = "COMMA"   // , 逗号
+	TTPercent    = "PERCENT" // % 百分号，后缀运算符
 
 	TTIdentifier = "IDENTIFIER" // 变量名
 	TTFunction   = "FUNCTION"   // 函数
 	TTEof        = "EOF"        // 结束符
+	TTIllegal    = "ILLEGAL"    // 非法token，仅在容错解析中出现
 )
 
 // 报错信息
@@ -42,30 +43,86 @@ const (
 	illegalSyntaxErrMsg = "Illegal Syntax"
 	illegalCalErrMsg    = "Illegal Calculation"
 	systemErrMsg        = "System Err"
+	illegalFuncErrMsg   = "Illegal Function"
+	typeErrMsg          = "Type Mismatch"
+	limitErrMsg         = "Limit Exceeded"
 )
 
-// 表示函数参数个数的特殊值
-const (
-	Abt    = -1 // arbitrarily 任意函数参数个数
-	GtZero = -2 // greater than 0，大于0个
-)
-
-var (
-	// FuncMap 函数map，规定函数调用哪个方法
-	FuncMap = map[string]func(...*decimal.Decimal) (*decimal.Decimal, error){
-		"MAX": max,
-		"MIN": min,
-		"IF":  if_,
-	}
+// builtinFuncs 内置函数，NewEngine 时加载
+var builtinFuncs = map[string]FuncSpec{
+	"MAX":   {MinArgs: 1, Variadic: true, Description: "返回最大值", Impl: max},
+	"MIN":   {MinArgs: 1, Variadic: true, Description: "返回最小值", Impl: min},
+	"IF":    {MinArgs: 3, MaxArgs: 3, Description: "IF(term, r1, r2)，若term为真返回r1，否则返回r2", Lazy: if_, pick: ifPick},
+	"AND":   {MinArgs: 1, Variadic: true, Description: "所有参数为真时返回真，否则返回假", Lazy: and_},
+	"OR":    {MinArgs: 1, Variadic: true, Description: "任一参数为真时返回真，否则返回假", Lazy: or_},
+	"TRUE":  {MinArgs: 0, MaxArgs: 0, Description: "返回真", Impl: true_},
+	"FALSE": {MinArgs: 0, MaxArgs: 0, Description: "返回假", Impl: false_},
 
-	// FuncParNumMap 函数参数个数map，用于校验。
-	FuncParNumMap = map[string]int{
-		"MAX": GtZero,
-		"MIN": GtZero,
-		"IF":  3,
-	}
-)
+	"LEN":        {MinArgs: 1, MaxArgs: 1, Description: "LEN(text)，返回字符个数", Impl: len_},
+	"UPPER":      {MinArgs: 1, MaxArgs: 1, Description: "UPPER(text)，转为大写", Impl: upper},
+	"LOWER":      {MinArgs: 1, MaxArgs: 1, Description: "LOWER(text)，转为小写", Impl: lower},
+	"TRIM":       {MinArgs: 1, MaxArgs: 1, Description: "TRIM(text)，去掉首尾空白字符", Impl: trim},
+	"LEFT":       {MinArgs: 1, MaxArgs: 2, Description: "LEFT(text, [n])，返回前n个字符", Impl: left},
+	"RIGHT":      {MinArgs: 1, MaxArgs: 2, Description: "RIGHT(text, [n])，返回后n个字符", Impl: right},
+	"MID":        {MinArgs: 3, MaxArgs: 3, Description: "MID(text, start, n)，返回从第start个字符开始的n个字符", Impl: mid},
+	"CONCAT":     {MinArgs: 1, Variadic: true, Description: "CONCAT(text1, ...)，拼接所有参数", Impl: concat},
+	"SUBSTITUTE": {MinArgs: 3, MaxArgs: 4, Description: "SUBSTITUTE(text, old, new, [instance])，将old替换为new", Impl: substitute},
+	"FIND":       {MinArgs: 2, MaxArgs: 3, Description: "FIND(find, within, [start])，返回find在within中首次出现的位置", Impl: find},
+	"TEXT":       {MinArgs: 1, MaxArgs: 2, Description: "TEXT(number, [format])，按格式格式化数字，如\"#,##0.00\"、\"0.0%\"", Impl: text},
+}
 
 const (
 	zeroStr = "0"
 )
+
+// escapeChars 字符串中'\\'后允许的字符及其含义
+var escapeChars = map[rune]rune{
+	'\\': '\\',
+	'"':  '"',
+	'\'': '\'',
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+}
+
+// opSymbols 运算符的规范写法，用于格式化
+var opSymbols = map[TT]string{
+	TTPlus:    "+",
+	TTMinus:   "-",
+	TTMul:     "*",
+	TTDiv:     "/",
+	TTPow:     "^",
+	TTAnd:     "&",
+	TTOr:      "|",
+	TTNot:     "!",
+	TTPercent: "%",
+	TTEq:      "=",
+	TTNeq:     "!=",
+	TTGt:      ">",
+	TTLt:      "<",
+	TTGte:     ">=",
+	TTLte:     "<=",
+}
+
+// fullWidthChars 全角标点 => 半角字符，词法分析时转换，字符串中的全角字符保持原样
+var fullWidthChars = map[rune]rune{
+	'　': ' ',
+	'（': '(',
+	'）': ')',
+	'，': ',',
+	'！': '!',
+	'＋': '+',
+	'－': '-',
+	'＊': '*',
+	'／': '/',
+	'＾': '^',
+	'％': '%',
+	'＆': '&',
+	'｜': '|',
+	'＝': '=',
+	'＞': '>',
+	'＜': '<',
+	'｛': '{',
+	'｝': '}',
+	'．': '.',
+}
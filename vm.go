@@ -0,0 +1,415 @@
+package formula_engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"strings"
+	"sync"
+)
+
+// opcode 字节码操作码
+type opcode uint8
+
+const (
+	opConst        opcode = iota // 压入常量 consts[arg]
+	opVar                        // 压入变量 tok.Value 的值
+	opUnary                      // 弹出1个值，压入 unOps[arg] 的计算结果
+	opBinary                     // 弹出2个值，压入 binOps[arg] 的计算结果
+	opShortCircuit               // & | 短路：栈顶的值能决定结果时，替换栈顶为结果并跳转到arg
+	opJump                       // 跳转到arg
+	opCall                       // 弹出 calls[arg] 的参数个数个值，压入函数结果
+	opLazyCall                   // 调用惰性函数 calls[arg]，参数为从各起始位置执行到 opReturn 的子程序
+	opReturn                     // 弹出栈顶的值并返回
+)
+
+var opNames = [...]string{"CONST", "VAR", "UNARY", "BINARY", "SHORT", "JUMP", "CALL", "LAZY_CALL", "RETURN"}
+
+// instr 字节码指令
+type instr struct {
+	op  opcode
+	arg int
+	tok *token // 用于报错定位
+}
+
+// callSite 函数调用点
+type callSite struct {
+	spec   FuncSpec
+	argc   int
+	starts []int // 惰性函数各参数子程序的起始位置
+}
+
+// Program 编译后的字节码程序，不可变，可被多个 VM 共享
+type Program struct {
+	code      []instr
+	consts    []Value
+	unOps     []func(p Value) (Value, error)
+	binOps    []func(p1 Value, p2 Value) (Value, error)
+	ctxBinOps []func(ctx context.Context, p1 Value, p2 Value) (Value, error) // 与 binOps 对应的可中断运算，可为nil
+	calls     []callSite
+	maxStack  int
+	depth     int // ast树的深度，用于 WithMaxDepth
+	pool      sync.Pool
+}
+
+// CompileProgram 使用默认Engine将公式编译为字节码
+func CompileProgram(str string) (*Program, error) {
+	return defaultEngine.CompileProgram(str)
+}
+
+// CompileProgram 将公式编译为字节码
+func (e *Engine) CompileProgram(str string) (*Program, error) {
+	node, err := e.GetAstTreeByString(str)
+	if err != nil {
+		return nil, err
+	}
+	return e.CompileProgramAstTree(node)
+}
+
+// CompileProgramAstTree 将ast树编译为字节码，函数、运算符在编译时绑定
+func (e *Engine) CompileProgramAstTree(node AstNode) (*Program, error) {
+	c := &progCompiler{engine: e, prog: &Program{depth: astDepth(node)}}
+	if err := c.compile(node); err != nil {
+		return nil, err
+	}
+	c.emit(opReturn, 0, node.GetTok())
+	return c.prog, nil
+}
+
+// String 反汇编，用于调试
+func (p *Program) String() string {
+	var str strings.Builder
+	for pc, in := range p.code {
+		str.WriteString(fmt.Sprintf("%04d %-10s %d", pc, opNames[in.op], in.arg))
+		switch in.op {
+		case opConst:
+			str.WriteString(fmt.Sprintf("\t; %s", p.consts[in.arg]))
+		case opVar, opUnary, opBinary, opCall, opLazyCall:
+			str.WriteString(fmt.Sprintf("\t; %s", in.tok.Value))
+		}
+		str.WriteByte('\n')
+	}
+	return str.String()
+}
+
+// Eval 从池中取 VM 计算，可并发调用
+func (p *Program) Eval(identifierMap map[string]string, opts ...EvalOption) (Value, error) {
+	vm, ok := p.pool.Get().(*VM)
+	if !ok {
+		vm = p.NewVM()
+	}
+	res, err := vm.Run(identifierMap, opts...)
+	p.pool.Put(vm)
+	return res, err
+}
+
+// EvalContext 从池中取 VM 计算，计算中检查 ctx 是否已取消或超时
+func (p *Program) EvalContext(ctx context.Context, identifierMap map[string]string, opts ...EvalOption) (Value, error) {
+	vm, ok := p.pool.Get().(*VM)
+	if !ok {
+		vm = p.NewVM()
+	}
+	res, err := vm.RunContext(ctx, identifierMap, opts...)
+	p.pool.Put(vm)
+	return res, err
+}
+
+//--------------------------------------------------------------------------------
+//--------------------------------------------------------------------------------
+
+// progCompiler 字节码编译器
+type progCompiler struct {
+	engine *Engine
+	prog   *Program
+	depth  int // 当前栈深度
+}
+
+// emit 添加指令，返回指令位置
+func (c *progCompiler) emit(op opcode, arg int, tok *token) int {
+	c.prog.code = append(c.prog.code, instr{op: op, arg: arg, tok: tok})
+	return len(c.prog.code) - 1
+}
+
+// push 记录栈深度变化
+func (c *progCompiler) push(n int) {
+	c.depth += n
+	if c.depth > c.prog.maxStack {
+		c.prog.maxStack = c.depth
+	}
+}
+
+// compile 编译节点，执行后栈顶为节点的值
+func (c *progCompiler) compile(node AstNode) error {
+	tok := node.GetTok()
+	switch node.GetName() {
+	case astSinNodeName:
+		return c.compileSin(tok)
+	case astUnNodeName:
+		if tok.Type == TTIllegal {
+			return illegalNodeErr(tok)
+		}
+		if err := c.compile(node.(*astUnNode).Node); err != nil {
+			return err
+		}
+		fun, ok := c.engine.unVisMap[tok.Type]
+		if !ok {
+			return makeErrWithToken(tok, systemErrMsg, fmt.Sprintf("UnKnow Unary type %s", tok.Type))
+		}
+		c.prog.unOps = append(c.prog.unOps, fun)
+		c.emit(opUnary, len(c.prog.unOps)-1, tok)
+		return nil
+	case astBinNodeName:
+		return c.compileBin(node.(*astBinNode))
+	case astGeneralNodeName:
+		return c.compileGeneral(node.(*astGeneralNode))
+	}
+	return makeErrWithToken(tok, systemErrMsg, fmt.Sprintf("UnKnow node type %s", node.GetName()))
+}
+
+// compileSin 编译单节点
+func (c *progCompiler) compileSin(tok *token) error {
+	var val Value
+	switch tok.Type {
+	case TTIdentifier:
+		c.emit(opVar, 0, tok)
+		c.push(1)
+		return nil
+	case TTNum:
+		dec, err := decimal.NewFromString(tok.Value)
+		if err != nil {
+			return makeErrWithToken(tok, systemErrMsg, err.Error())
+		}
+		val = NumberValue(dec)
+	case TTString:
+		val = StringValue(tok.Value)
+	default:
+		return illegalNodeErr(tok)
+	}
+	c.prog.consts = append(c.prog.consts, val)
+	c.emit(opConst, len(c.prog.consts)-1, tok)
+	c.push(1)
+	return nil
+}
+
+// compileBin 编译二叉节点，& | 编译为短路跳转
+func (c *progCompiler) compileBin(node *astBinNode) error {
+	tok := node.Tok
+	fun, ok := c.engine.binVisMap[tok.Type]
+	if !ok {
+		return makeErrWithToken(tok, systemErrMsg, fmt.Sprintf("UnKnow Binary type %s", tok.Type))
+	}
+	if err := c.compile(node.LNode); err != nil {
+		return err
+	}
+	jump := -1
+	if c.engine.shortCircuitOps[tok.Type] {
+		jump = c.emit(opShortCircuit, 0, tok)
+	}
+	if err := c.compile(node.RNode); err != nil {
+		return err
+	}
+	c.prog.binOps = append(c.prog.binOps, fun)
+	c.prog.ctxBinOps = append(c.prog.ctxBinOps, c.engine.ctxBinVisMap[tok.Type])
+	c.emit(opBinary, len(c.prog.binOps)-1, tok)
+	c.push(-1)
+	if jump >= 0 {
+		c.prog.code[jump].arg = len(c.prog.code)
+	}
+	return nil
+}
+
+// compileGeneral 编译函数节点。惰性函数的参数编译为以 opReturn 结尾的子程序，主流程跳过这些子程序
+func (c *progCompiler) compileGeneral(node *astGeneralNode) error {
+	tok := node.Tok
+	spec, ok := c.engine.lookupFunc(tok.Value)
+	if !ok {
+		return makeErrWithToken(tok, illegalSyntaxErrMsg, fmt.Sprintf("UnKnow function name %s", tok.Value))
+	}
+	if err := spec.checkArgs(tok.Value, len(node.Nodes)); err != nil {
+		return withTok(err, tok)
+	}
+	site := callSite{spec: spec, argc: len(node.Nodes)}
+
+	if spec.Lazy == nil {
+		for _, n := range node.Nodes {
+			if err := c.compile(n); err != nil {
+				return err
+			}
+		}
+		c.prog.calls = append(c.prog.calls, site)
+		c.emit(opCall, len(c.prog.calls)-1, tok)
+		c.push(1 - site.argc)
+		return nil
+	}
+
+	jump := c.emit(opJump, 0, tok)
+	depth := c.depth
+	for _, n := range node.Nodes {
+		site.starts = append(site.starts, len(c.prog.code))
+		if err := c.compile(n); err != nil {
+			return err
+		}
+		c.emit(opReturn, 0, n.GetTok())
+		c.depth = depth
+	}
+	c.prog.code[jump].arg = len(c.prog.code)
+	c.prog.calls = append(c.prog.calls, site)
+	c.emit(opLazyCall, len(c.prog.calls)-1, tok)
+	c.push(1)
+	return nil
+}
+
+//--------------------------------------------------------------------------------
+//--------------------------------------------------------------------------------
+
+// VM 字节码虚拟机，操作数栈预先分配，重复计算时不再分配。VM 不能并发使用，并发时每个goroutine使用各自的 VM
+type VM struct {
+	prog          *Program
+	stack         []Value
+	thunks        [][]Thunk // 各调用点的惰性参数，创建 VM 时生成
+	identifierMap map[string]string
+	config        evalConfig
+}
+
+// NewVM 创建执行该程序的 VM
+func (p *Program) NewVM() *VM {
+	vm := &VM{
+		prog:   p,
+		stack:  make([]Value, 0, p.maxStack),
+		thunks: make([][]Thunk, len(p.calls)),
+	}
+	for idx, site := range p.calls {
+		for _, start := range site.starts {
+			start := start
+			vm.thunks[idx] = append(vm.thunks[idx], func() (Value, error) {
+				return vm.sub(start)
+			})
+		}
+	}
+	return vm
+}
+
+// Run 计算，返回带类型的值。结果可能为错误值，此时err为nil
+func (vm *VM) Run(identifierMap map[string]string, opts ...EvalOption) (Value, error) {
+	return vm.run(nil, identifierMap, opts...)
+}
+
+// RunContext 计算，计算中检查 ctx 是否已取消或超时。WithMaxDepth 按ast树的深度检查
+func (vm *VM) RunContext(ctx context.Context, identifierMap map[string]string, opts ...EvalOption) (Value, error) {
+	return vm.run(ctx, identifierMap, opts...)
+}
+
+// run 计算，ctx 可为nil
+func (vm *VM) run(ctx context.Context, identifierMap map[string]string, opts ...EvalOption) (Value, error) {
+	vm.identifierMap = identifierMap
+	vm.config = evalConfig{ctx: ctx}
+	for _, opt := range opts {
+		opt(&vm.config)
+	}
+	var res Value
+	err := vm.config.checkDepth(vm.prog.depth, vm.prog.code[len(vm.prog.code)-1].tok)
+	if err == nil {
+		res, err = vm.config.result(vm.exec(0))
+	}
+	vm.stack = vm.stack[:0]
+	vm.identifierMap = nil
+	vm.config.ctx = nil
+	return res, err
+}
+
+// push 压栈
+func (vm *VM) push(v Value) {
+	vm.stack = append(vm.stack, v)
+}
+
+// sub 执行惰性参数的子程序。出错时恢复栈，惰性函数忽略该错误后可继续执行
+func (vm *VM) sub(start int) (Value, error) {
+	base := len(vm.stack)
+	res, err := vm.exec(start)
+	if err != nil {
+		vm.stack = vm.stack[:base]
+	}
+	return res, err
+}
+
+// exec 从pc开始执行，直到 opReturn
+func (vm *VM) exec(pc int) (Value, error) {
+	prog := vm.prog
+	limited := vm.config.limited()
+	for {
+		in := prog.code[pc]
+		if limited {
+			if err := vm.config.step(in.tok); err != nil {
+				return Value{}, err
+			}
+		}
+		top := len(vm.stack) - 1
+		switch in.op {
+		case opConst:
+			vm.push(prog.consts[in.arg])
+		case opVar:
+			v, err := vm.config.lookup(vm.identifierMap, in.tok)
+			if err != nil {
+				return Value{}, err
+			}
+			vm.push(v)
+		case opUnary:
+			res, err := prog.unOps[in.arg](vm.stack[top])
+			if err != nil {
+				return Value{}, withTok(err, in.tok)
+			}
+			vm.stack[top] = res
+		case opBinary:
+			res, err := vm.config.binary(in.tok, prog.binOps[in.arg], prog.ctxBinOps[in.arg], vm.stack[top-1], vm.stack[top])
+			if err != nil {
+				return Value{}, withTok(err, in.tok)
+			}
+			vm.stack = vm.stack[:top]
+			vm.stack[top-1] = res
+		case opShortCircuit:
+			res, ok, err := shortCircuit(in.tok.Type, vm.stack[top])
+			if err != nil {
+				return Value{}, withTok(err, in.tok)
+			}
+			if ok {
+				vm.stack[top] = res
+				pc = in.arg
+				continue
+			}
+		case opJump:
+			pc = in.arg
+			continue
+		case opCall:
+			site := prog.calls[in.arg]
+			args := vm.stack[len(vm.stack)-site.argc:]
+			var res Value
+			if errVal, ok := propagateErr(args...); ok {
+				res = errVal
+			} else {
+				var err error
+				res, err = site.spec.Impl(args...)
+				if err != nil {
+					return Value{}, withTok(err, in.tok)
+				}
+			}
+			vm.stack = vm.stack[:len(vm.stack)-site.argc]
+			vm.push(res)
+		case opLazyCall:
+			res, err := prog.calls[in.arg].spec.Lazy(vm.thunks[in.arg]...)
+			if err != nil {
+				return Value{}, withTok(err, in.tok)
+			}
+			vm.push(res)
+		case opReturn:
+			res := vm.stack[top]
+			vm.stack = vm.stack[:top]
+			return res, nil
+		}
+		if limited {
+			if err := vm.config.checkDigits(vm.stack[len(vm.stack)-1], in.tok); err != nil {
+				return Value{}, err
+			}
+		}
+		pc++
+	}
+}